@@ -1,10 +1,18 @@
 package annoy
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
@@ -157,3 +165,769 @@ func TestAnnoy(t *testing.T) {
 	assert.NotNil(t, n)
 	assert.Equal(t, []int64{34, 28, 60, 17, 54}, n)
 }
+
+func TestSaveLoad(t *testing.T) {
+	w := NewWorld()
+
+	original, err := NewIndex(w.toDataset(), 2, 10, 5)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, original.Save(&buf))
+
+	loaded, err := Load(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.NotNil(t, loaded)
+	assert.Equal(t, len(original.(*index).items), len(loaded.(*index).items))
+	assert.Equal(t, len(original.(*index).nodes), len(loaded.(*index).nodes))
+
+	for id := int64(0); id < int64(len(w.capitals)); id++ {
+		expected, err := original.FindSimilarById(id, 5, 5)
+		assert.NoError(t, err)
+		n, err := loaded.FindSimilarById(id, 5, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n)
+	}
+
+	// saving the loaded index produces the same bytes
+	var again bytes.Buffer
+	assert.NoError(t, loaded.Save(&again))
+	assert.Equal(t, buf.Bytes(), again.Bytes())
+}
+
+func TestLoadInvalid(t *testing.T) {
+	w := NewWorld()
+
+	index, err := NewIndex(w.toDataset(), 2, 3, 5)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, index.Save(&buf))
+	data := buf.Bytes()
+
+	corrupt := func(f func(b []byte)) []byte {
+		b := append([]byte{}, data...)
+		f(b)
+		return b
+	}
+
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { b[0] = 'X' })))
+	assert.ErrorContains(t, err, "not an annoy index file")
+
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[4:], 99) })))
+	assert.ErrorContains(t, err, "unsupported index format version 99")
+
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[8:], 0) })))
+	assert.ErrorContains(t, err, "invalid index dimension 0")
+
+	_, err = Load(bytes.NewReader(data[:len(data)-1]))
+	assert.ErrorContains(t, err, "reading leaves")
+
+	// counts larger than the input fail once the input is exhausted, without allocating them up front
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint64(b[24:], 1<<31) })))
+	assert.EqualError(t, err, "reading item ids: unexpected EOF")
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[8:], 1<<31) })))
+	assert.EqualError(t, err, "reading vector of item 0: unexpected EOF")
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint64(b[32:], 1<<31) })))
+	assert.ErrorContains(t, err, ": unexpected EOF")
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint64(b[40:], 1<<31) })))
+	assert.EqualError(t, err, "reading leaves: unexpected EOF")
+
+	// point the first tree root outside of the nodes block
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[48:], 1<<20) })))
+	assert.ErrorContains(t, err, "invalid tree 0: node 1048576 out of range")
+
+	// make the second tree share the root of the first one
+	_, err = Load(bytes.NewReader(corrupt(func(b []byte) { copy(b[52:56], b[48:52]) })))
+	assert.ErrorContains(t, err, "referenced more than once")
+}
+
+func TestOpenMmap(t *testing.T) {
+	w := NewWorld()
+
+	original, err := NewIndex(w.toDataset(), 2, 10, 5)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, original.Save(&buf))
+	path := filepath.Join(t.TempDir(), "capitals.idx")
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+
+	mapped, err := OpenMmap(path)
+	assert.NoError(t, err)
+
+	for id := int64(0); id < int64(len(w.capitals)); id++ {
+		expected, err := original.FindSimilarById(id, 5, 5)
+		assert.NoError(t, err)
+		n, err := mapped.FindSimilarById(id, 5, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n)
+	}
+
+	_, err = mapped.FindSimilarById(int64(len(w.capitals)), 5, 5)
+	assert.Error(t, err)
+
+	var again bytes.Buffer
+	assert.NoError(t, mapped.Save(&again))
+	assert.Equal(t, buf.Bytes(), again.Bytes())
+
+	assert.NoError(t, mapped.Close())
+	_, err = mapped.FindSimilarByVector([]float64{41.9, 12.483333}, 5, 5)
+	assert.ErrorContains(t, err, "index is closed")
+
+	// truncated files are rejected
+	assert.NoError(t, os.WriteFile(path, buf.Bytes()[:buf.Len()-4], 0o644))
+	_, err = OpenMmap(path)
+	assert.ErrorContains(t, err, "invalid index size")
+}
+
+func TestOpenMmapInvalid(t *testing.T) {
+	w := NewWorld()
+
+	// with this seed the roots of all trees are split, so that the file has both inner nodes and leaves
+	original, err := NewIndex(w.toDataset(), 2, 3, 5, Options{Seed: 1})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, original.Save(&buf))
+	data := buf.Bytes()
+	valid, err := newMmapIndex(data, nil)
+	require.NoError(t, err)
+
+	corrupt := func(f func(b []byte)) error {
+		b := append([]byte{}, data...)
+		f(b)
+		_, err := newMmapIndex(b, nil)
+		return err
+	}
+	root := valid.nodesOffset + int(valid.roots()[0])*valid.nodeSize
+	inner, leaf := -1, -1
+	for n := uint32(0); n < uint32(valid.header.NumNodes); n++ {
+		rec := valid.record(n)
+		if rec.Left != noChild && inner < 0 {
+			inner = valid.nodesOffset + int(n)*valid.nodeSize
+		}
+		if rec.Left == noChild && rec.LeafCount > 0 && leaf < 0 {
+			leaf = valid.nodesOffset + int(n)*valid.nodeSize
+		}
+	}
+	require.GreaterOrEqual(t, inner, 0)
+	require.GreaterOrEqual(t, leaf, 0)
+
+	// the children of the root point back to it
+	err = corrupt(func(b []byte) {
+		binary.LittleEndian.PutUint32(b[root:], 0)
+		binary.LittleEndian.PutUint32(b[root+4:], 0)
+	})
+	assert.ErrorContains(t, err, "node 0 is referenced more than once")
+
+	err = corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[inner:], 1<<20) })
+	assert.ErrorContains(t, err, "node 1048576 out of range")
+
+	err = corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[inner+4:], noChild) })
+	assert.ErrorContains(t, err, "has a single child")
+
+	err = corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[leaf+12:], 1<<20) })
+	assert.ErrorContains(t, err, "out of range")
+
+	err = corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[valid.leavesOffset:], 1<<20) })
+	assert.ErrorContains(t, err, "references unknown item position 1048576")
+
+	// section sizes overflowing 64 bits do not wrap around the size check
+	err = corrupt(func(b []byte) {
+		binary.LittleEndian.PutUint32(b[8:], math.MaxUint32)
+		binary.LittleEndian.PutUint64(b[24:], math.MaxUint32)
+	})
+	assert.EqualError(t, err, "invalid index size, the sections overflow")
+}
+
+func TestAddRemove(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	// build the index on part of the capitals and add the others incrementally
+	index, err := NewIndex(dataset[:40], 2, 10, 5)
+	assert.NoError(t, err)
+	for id := 40; id < len(dataset); id++ {
+		assert.NoError(t, index.Add(int64(id), dataset[id]))
+	}
+
+	// a bucket larger than the dataset makes the search exhaustive
+	exhaustive := float64(len(dataset))
+	n, err := index.FindSimilarById(34, 5, exhaustive)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28, 60, 17, 54}, n)
+
+	assert.ErrorContains(t, index.Add(34, dataset[34]), "item 34 already exists")
+	assert.ErrorContains(t, index.Add(100, []float64{1, 2, 3}), "item 100 has dimension 3, expected 2")
+
+	// removed items are no longer returned
+	assert.NoError(t, index.Remove(28))
+	assert.ErrorContains(t, index.Remove(28), "no item found for id: 28")
+	_, err = index.FindSimilarById(28, 5, exhaustive)
+	assert.Error(t, err)
+	n, err = index.FindSimilarById(34, 5, exhaustive)
+	assert.NoError(t, err)
+	assert.NotContains(t, n, int64(28))
+	assert.Equal(t, []int64{34, 60, 17, 54}, n[:4])
+
+	// removed items can be added back
+	assert.NoError(t, index.Add(28, dataset[28]))
+	n, err = index.FindSimilarById(34, 5, exhaustive)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28, 60, 17, 54}, n)
+}
+
+func TestAddSplitsLeaves(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	// grow every tree from a single leaf of 3 capitals
+	grown, err := NewIndex(dataset[:3], 2, 5, 5, Options{Seed: 1})
+	assert.NoError(t, err)
+	for id := 3; id < len(dataset); id++ {
+		assert.NoError(t, grown.Add(int64(id), dataset[id]))
+	}
+	split := 0
+	for _, tr := range grown.(*index).trees {
+		leaves := 0
+		var walk func(n *node)
+		walk = func(n *node) {
+			if n.leftChild == nil {
+				leaves += len(n.leafItems)
+				return
+			}
+			// inner nodes do not keep the items moved to their children
+			assert.Empty(t, n.leafItems)
+			walk(n.leftChild)
+			walk(n.rightChild)
+		}
+		walk(tr)
+		assert.Equal(t, len(dataset), leaves)
+		if tr.leftChild != nil {
+			split++
+		}
+	}
+	assert.Greater(t, split, 0)
+
+	// identical vectors cannot be split, the leaf is only split again once it doubled
+	duplicates, err := NewIndex([][]float64{{1, 1}}, 2, 1, 2, Options{Seed: 1})
+	assert.NoError(t, err)
+	for id := int64(1); id < 10; id++ {
+		assert.NoError(t, duplicates.Add(id, []float64{1, 1}))
+	}
+	leaf := duplicates.(*index).trees[0]
+	assert.Nil(t, leaf.leftChild)
+	assert.Nil(t, leaf.split)
+	assert.Len(t, leaf.leafItems, 10)
+	assert.Equal(t, 12, leaf.splitAt)
+}
+
+func TestCompact(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	original, err := NewIndex(dataset, 2, 10, 5)
+	assert.NoError(t, err)
+	for id := int64(0); id < int64(len(dataset)); id += 2 {
+		assert.NoError(t, original.Remove(id))
+	}
+	assert.NoError(t, original.Compact())
+
+	idx := original.(*index)
+	assert.Empty(t, idx.deleted)
+	assert.Len(t, idx.items, len(dataset)/2)
+	for _, tr := range idx.trees {
+		leaves := 0
+		var count func(n *node)
+		count = func(n *node) {
+			if n.leftChild == nil {
+				leaves += len(n.leafItems)
+				return
+			}
+			count(n.leftChild)
+			count(n.rightChild)
+		}
+		count(tr)
+		assert.Equal(t, len(dataset)/2, leaves)
+	}
+
+	n, err := original.FindSimilarByVector(dataset[34], 5, float64(len(dataset)))
+	assert.NoError(t, err)
+	assert.Len(t, n, 5)
+	for _, id := range n {
+		assert.Equal(t, int64(1), id%2)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	// meant to be run with -race
+	w := NewWorld()
+	dataset := w.toDataset()
+	shared, err := NewIndex(dataset, 2, 10, 5, Options{Seed: 7})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	// readers only query the items that are never removed
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := int64(1 + 2*((r+j)%(len(dataset)/2)))
+				if _, err := shared.FindSimilarByVector(dataset[id], 5, 10); err != nil {
+					errs <- err
+				}
+				if _, err := shared.SearchById(id, 5, SearchOptions{}); err != nil {
+					errs <- err
+				}
+				if _, err := shared.FindWithinDistance(dataset[id], 0.1, 0); err != nil {
+					errs <- err
+				}
+				if err := shared.Save(&bytes.Buffer{}); err != nil {
+					errs <- err
+				}
+			}
+		}(r)
+	}
+	// writers add new items, remove the even ones and compact the trees
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < len(dataset); j++ {
+			if err := shared.Add(int64(1000+j), dataset[j]); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for id := int64(0); id < int64(len(dataset)); id += 2 {
+			if err := shared.Remove(id); err != nil {
+				errs <- err
+			}
+			if id%20 == 0 {
+				if err := shared.Compact(); err != nil {
+					errs <- err
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, shared.Compact())
+	idx := shared.(*index)
+	assert.Empty(t, idx.deleted)
+	assert.Len(t, idx.items, len(dataset)+len(dataset)/2)
+	n, err := shared.FindSimilarById(1000, 1, float64(len(dataset)))
+	assert.NoError(t, err)
+	assert.Len(t, n, 1)
+}
+
+func TestNewIndexFromItems(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	// ids unrelated to the position of the capitals, passed in reverse order
+	idOf := func(position int) int64 { return int64(1000 + 7*position) }
+	items := make([]Item, 0, len(dataset))
+	data := make(map[int64][]float64, len(dataset))
+	for p := len(dataset) - 1; p >= 0; p-- {
+		items = append(items, Item{ID: idOf(p), Vector: dataset[p]})
+		data[idOf(p)] = dataset[p]
+	}
+	expected := []int64{idOf(34), idOf(28), idOf(60), idOf(17), idOf(54)}
+
+	fromItems, err := NewIndexFromItems(items, 2, 10, 5)
+	assert.NoError(t, err)
+	n, err := fromItems.FindSimilarById(idOf(34), 5, float64(len(dataset)))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, n)
+
+	fromMap, err := NewIndexFromMap(data, 2, 10, 5)
+	assert.NoError(t, err)
+	n, err = fromMap.FindSimilarById(idOf(34), 5, float64(len(dataset)))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, n)
+
+	_, err = fromMap.FindSimilarById(34, 5, 5)
+	assert.ErrorContains(t, err, "No item found for id: 34")
+
+	_, err = NewIndexFromItems([]Item{{ID: 1, Vector: []float64{1, 2}}, {ID: 1, Vector: []float64{3, 4}}}, 2, 1, 5)
+	assert.ErrorContains(t, err, "duplicate item id 1")
+	_, err = NewIndexFromItems([]Item{{ID: 1, Vector: []float64{1, 2, 3}}}, 2, 1, 5)
+	assert.ErrorContains(t, err, "item 1 has dimension 3, expected 2")
+}
+
+func TestMetrics(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+	exhaustive := float64(len(dataset))
+
+	// distance from Rome, Italy
+	for metric, expected := range map[Metric][]int64{
+		Angular:   {34, 28, 60, 17, 54},
+		Euclidean: {34, 28, 54, 57, 15},
+		Manhattan: {34, 28, 54, 57, 46},
+		Dot:       {59, 36, 21, 53, 19},
+	} {
+		built, err := NewIndex(dataset, 2, 10, 5, Options{Metric: metric})
+		assert.NoError(t, err)
+		n, err := built.FindSimilarByVector(dataset[34], 5, exhaustive)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n, metric.String())
+
+		// the metric is persisted along with the index
+		var buf bytes.Buffer
+		assert.NoError(t, built.Save(&buf))
+		loaded, err := Load(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, metric, loaded.(*index).metric)
+	}
+
+	bits := [][]float64{
+		{1, 1, 1, 1, 0, 0, 0, 0},
+		{1, 1, 1, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 1, 1, 1, 1},
+		{0, 0, 0, 1, 1, 1, 1, 1},
+		{1, 0, 1, 0, 1, 0, 1, 0},
+	}
+	index, err := NewIndex(bits, 8, 3, 2, Options{Metric: Hamming})
+	assert.NoError(t, err)
+	n, err := index.FindSimilarByVector([]float64{1, 1, 1, 1, 1, 0, 0, 0}, 3, float64(len(bits)))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 1, 4}, n)
+
+	_, err = NewIndex(dataset, 2, 10, 5, Options{Metric: Metric(42)})
+	assert.ErrorContains(t, err, "unknown metric 42")
+}
+
+func TestFindNeighbors(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	built, err := NewIndex(dataset, 2, 10, 5, Options{Metric: Euclidean})
+	assert.NoError(t, err)
+
+	n, err := built.FindNeighborsById(34, 3, float64(len(dataset)))
+	assert.NoError(t, err)
+	assert.Len(t, n, 3)
+	assert.Equal(t, []int64{34, 28, 54}, neighbourIds(n))
+	assert.Equal(t, 0.0, n[0].Distance)
+	assert.InDelta(t, 0.033333, n[1].Distance, 1e-6)
+	assert.InDelta(t, 2.034426, n[2].Distance, 1e-6)
+
+	v, err := built.FindNeighborsByVector(dataset[34], 3, float64(len(dataset)))
+	assert.NoError(t, err)
+	assert.Equal(t, n, v)
+
+	_, err = built.FindNeighborsById(1000, 3, 5)
+	assert.ErrorContains(t, err, "No item found for id: 1000")
+}
+
+func TestFindWithinDistance(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	built, err := NewIndex(dataset, 2, 10, 5, Options{Metric: Euclidean})
+	assert.NoError(t, err)
+
+	n, err := built.FindWithinDistance(dataset[34], 2.1, len(dataset))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28, 54}, neighbourIds(n))
+
+	n, err = built.FindWithinDistance(dataset[34], 0.05, len(dataset))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28}, neighbourIds(n))
+
+	n, err = built.FindWithinDistance([]float64{0, 0}, 1, len(dataset))
+	assert.NoError(t, err)
+	assert.Empty(t, n)
+
+	// the default budget inspects at least the leaf of the query in every tree
+	n, err = built.FindWithinDistance(dataset[34], 0.05, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28}, neighbourIds(n))
+}
+
+func TestSearch(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	built, err := NewIndex(dataset, 2, 10, 5, Options{Metric: Euclidean})
+	assert.NoError(t, err)
+
+	// inspecting every node of every tree makes the search exhaustive
+	exhaustive := SearchOptions{SearchK: 10 * len(dataset)}
+	n, err := built.Search(dataset[34], 5, exhaustive)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28, 54, 57, 15}, neighbourIds(n))
+
+	byId, err := built.SearchById(34, 5, exhaustive)
+	assert.NoError(t, err)
+	assert.Equal(t, n, byId)
+
+	// the budget does not depend on k
+	n, err = built.Search(dataset[34], 1, exhaustive)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34}, neighbourIds(n))
+
+	// the default budget inspects k * numberOfTrees nodes
+	n, err = built.Search(dataset[34], 2, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{34, 28}, neighbourIds(n))
+
+	_, err = built.SearchById(1000, 5, SearchOptions{})
+	assert.ErrorContains(t, err, "No item found for id: 1000")
+
+	_, err = built.Search(dataset[34], -1, SearchOptions{})
+	assert.EqualError(t, err, "invalid number of neighbours -1")
+	_, err = built.FindSimilarByVector(dataset[34], -1, 5)
+	assert.EqualError(t, err, "invalid number of neighbours -1")
+	_, err = built.FindSimilarBatch(dataset[:2], -1, SearchOptions{})
+	assert.EqualError(t, err, "query 0: invalid number of neighbours -1")
+}
+
+func TestSearchFilter(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	built, err := NewIndex(dataset, 2, 10, 3, Options{Metric: Euclidean, Seed: 5})
+	assert.NoError(t, err)
+
+	// the budget is extended until enough items match
+	tenth := func(id int64) bool { return id%10 == 0 }
+	n, err := built.Search(dataset[34], 5, SearchOptions{SearchK: 1, Filter: tenth})
+	assert.NoError(t, err)
+	assert.Len(t, n, 5)
+	for _, neighbour := range n {
+		assert.True(t, tenth(neighbour.ID))
+	}
+	exhaustive, err := built.Search(dataset[34], 5, SearchOptions{SearchK: 10 * len(dataset), Filter: tenth})
+	assert.NoError(t, err)
+	assert.Len(t, exhaustive, 5)
+
+	// a filter matching a single item returns it whatever its distance
+	n, err = built.SearchById(34, 5, SearchOptions{Filter: func(id int64) bool { return id == 3 }})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{3}, neighbourIds(n))
+
+	n, err = built.Search(dataset[34], 5, SearchOptions{Filter: func(id int64) bool { return false }})
+	assert.NoError(t, err)
+	assert.Empty(t, n)
+
+	// the filter gets the ids exposed to callers
+	var buf bytes.Buffer
+	assert.NoError(t, built.Save(&buf))
+	path := filepath.Join(t.TempDir(), "index.ann")
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	mapped, err := OpenMmap(path)
+	assert.NoError(t, err)
+	defer mapped.Close()
+	n, err = mapped.Search(dataset[34], 5, SearchOptions{Filter: tenth})
+	assert.NoError(t, err)
+	assert.Len(t, n, 5)
+	for _, neighbour := range n {
+		assert.True(t, tenth(neighbour.ID))
+	}
+}
+
+func TestFindSimilarBatch(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	built, err := NewIndex(dataset, 2, 10, 5, Options{Metric: Euclidean, Seed: 3})
+	assert.NoError(t, err)
+
+	for _, workers := range []int{0, 1, 4, 2 * len(dataset)} {
+		opts := SearchOptions{SearchK: 100, Workers: workers}
+		batch, err := built.FindSimilarBatch(dataset, 3, opts)
+		assert.NoError(t, err)
+		assert.Len(t, batch, len(dataset))
+		for j, v := range dataset {
+			n, err := built.Search(v, 3, opts)
+			assert.NoError(t, err)
+			assert.Equal(t, n, batch[j])
+		}
+	}
+
+	batch, err := built.FindSimilarBatch(nil, 3, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, batch)
+
+	_, err = built.FindSimilarBatch([][]float64{dataset[0], {1, 2, 3}}, 3, SearchOptions{})
+	assert.ErrorContains(t, err, "query 1")
+}
+
+func TestSplitOffsets(t *testing.T) {
+	// a uniform grid far from the origin, where hyperplanes through the origin cannot split the points
+	grid := [][]float64{}
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			grid = append(grid, []float64{1000 + float64(x), 1000 + float64(y)})
+		}
+	}
+
+	built, err := NewIndex(grid, 2, 10, 5, Options{Metric: Euclidean})
+	assert.NoError(t, err)
+
+	var largestLeaf func(n *node) int
+	largestLeaf = func(n *node) int {
+		if n.leftChild == nil {
+			return len(n.leafItems)
+		}
+		l, r := largestLeaf(n.leftChild), largestLeaf(n.rightChild)
+		if l > r {
+			return l
+		}
+		return r
+	}
+	for _, tr := range built.(*index).trees {
+		assert.NotNil(t, tr.leftChild)
+		assert.NotZero(t, tr.offset)
+		assert.Less(t, largestLeaf(tr), len(grid)/2)
+	}
+
+	// the offsets are persisted along with the index
+	var buf bytes.Buffer
+	assert.NoError(t, built.Save(&buf))
+	loaded, err := Load(&buf)
+	assert.NoError(t, err)
+	for tr, root := range built.(*index).trees {
+		assert.Equal(t, root.offset, loaded.(*index).trees[tr].offset)
+	}
+
+	// the query margin takes the offsets into account, so that few nodes are enough to find the closest point
+	n, err := loaded.Search([]float64{1004.1, 1006.2}, 1, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{46}, neighbourIds(n))
+}
+
+func TestSeededBuild(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	save := func(idx Index) []byte {
+		var buf bytes.Buffer
+		assert.NoError(t, idx.Save(&buf))
+		return buf.Bytes()
+	}
+	build := func(seed int64) Index {
+		built, err := NewIndex(dataset[:50], 2, 10, 3, Options{Metric: Euclidean, Seed: seed})
+		assert.NoError(t, err)
+		// leaves grown by Add are split with the seeded random source as well
+		for id := 50; id < len(dataset); id++ {
+			assert.NoError(t, built.Add(int64(id), dataset[id]))
+		}
+		return built
+	}
+
+	first, second := build(42), build(42)
+	assert.Equal(t, save(first), save(second))
+	for tr, root := range first.(*index).trees {
+		assert.Equal(t, root.id, second.(*index).trees[tr].id)
+	}
+
+	assert.NotEqual(t, save(first), save(build(43)))
+}
+
+func TestSplitStrategies(t *testing.T) {
+	w := NewWorld()
+	dataset := w.toDataset()
+
+	for _, strategy := range []SplitStrategy{FastTwoMeans, ExactKMeans} {
+		built, err := NewIndex(dataset, 2, 10, 5, Options{Metric: Euclidean, Split: strategy})
+		assert.NoError(t, err)
+		n, err := built.Search(dataset[34], 5, SearchOptions{SearchK: 10 * len(dataset)})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{34, 28, 54, 57, 15}, neighbourIds(n), strategy.String())
+	}
+
+	_, err := NewIndex(dataset, 2, 10, 5, Options{Split: SplitStrategy(7)})
+	assert.ErrorContains(t, err, "unknown split strategy 7")
+
+	// a single item cannot be split
+	single, err := NewIndex(dataset[:1], 2, 3, 5)
+	assert.NoError(t, err)
+	n, err := single.FindSimilarById(0, 5, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0}, n)
+}
+
+func TestSample(t *testing.T) {
+	dataItems, _ := dataItemsFromRawData(make([][]float64, 1000))
+	b := newBuilder(5, Options{Seed: 1})
+
+	sampled := sample(dataItems, twoMeansSampleSize, b)
+	assert.Len(t, sampled, twoMeansSampleSize)
+	distinct := map[dataItemId]struct{}{}
+	for _, it := range sampled {
+		distinct[it.id] = struct{}{}
+	}
+	assert.Len(t, distinct, twoMeansSampleSize)
+
+	assert.Equal(t, dataItems[:10], sample(dataItems[:10], twoMeansSampleSize, b))
+}
+
+func TestBuildWorkers(t *testing.T) {
+	// enough items for the subtrees to be built in parallel
+	rng := rand.New(rand.NewSource(1234))
+	items := make([]Item, 2*parallelBuildThreshold)
+	for i := range items {
+		items[i] = Item{ID: int64(i), Vector: []float64{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}}
+	}
+
+	var calls []Progress
+	serial, err := NewIndexFromItems(items, 3, 4, 50, Options{Metric: Euclidean, Seed: 42, Workers: 1})
+	assert.NoError(t, err)
+	parallel, err := NewIndexFromItems(items, 3, 4, 50, Options{Metric: Euclidean, Seed: 42, Workers: 8,
+		Progress: func(p Progress) { calls = append(calls, p) }})
+	assert.NoError(t, err)
+
+	// the trees do not depend on the number of workers
+	var serialBytes, parallelBytes bytes.Buffer
+	assert.NoError(t, serial.Save(&serialBytes))
+	assert.NoError(t, parallel.Save(&parallelBytes))
+	assert.Equal(t, serialBytes.Bytes(), parallelBytes.Bytes())
+
+	assert.NotEmpty(t, calls)
+	last := calls[len(calls)-1]
+	assert.Equal(t, 4, last.Trees)
+	assert.Equal(t, 4, last.TreesDone)
+	assert.Greater(t, last.NodesBuilt, int64(0))
+	for j := 1; j < len(calls); j++ {
+		assert.GreaterOrEqual(t, calls[j].TreesDone, calls[j-1].TreesDone)
+	}
+
+	// a cancelled build stops with the error of the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	index, err := NewIndexContext(ctx, items, 3, 4, 50, Options{Seed: 42})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, index)
+}
+
+func BenchmarkNewIndex(b *testing.B) {
+	rng := rand.New(rand.NewSource(1234))
+	dataset := make([][]float64, 5000)
+	for i := range dataset {
+		dataset[i] = make([]float64, 16)
+		for d := range dataset[i] {
+			dataset[i][d] = rng.NormFloat64()
+		}
+	}
+
+	for _, strategy := range []SplitStrategy{FastTwoMeans, ExactKMeans} {
+		b.Run(strategy.String(), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				if _, err := NewIndex(dataset, 16, 5, 20, Options{Metric: Euclidean, Split: strategy, Seed: 1}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
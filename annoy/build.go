@@ -0,0 +1,180 @@
+package annoy
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// parallelBuildThreshold ... min number of items of a node for its children to be built in parallel
+	parallelBuildThreshold = 10000
+	// progressInterval ... number of nodes built between two progress reports
+	progressInterval = 1000
+)
+
+// Progress reports the state of an index build
+type Progress struct {
+	// Trees ... number of trees to build
+	Trees int
+	// TreesDone ... number of trees completely built
+	TreesDone int
+	// NodesBuilt ... number of nodes built so far, across all trees
+	NodesBuilt int64
+}
+
+// builder holds the settings and the random source used to build the nodes of a tree,
+// it must not be shared between goroutines
+type builder struct {
+	// k ... num items in a leaf node
+	k      int
+	metric Metric
+	split  SplitStrategy
+	rng    *rand.Rand
+
+	// workers, progress ... settings of the build runs started from this builder
+	workers  int
+	progress func(Progress)
+	// run ... build the nodes belong to, nil for the nodes split by Add
+	run *buildRun
+}
+
+func newBuilder(k int, options Options) *builder {
+	return &builder{
+		k:        k,
+		metric:   options.Metric,
+		split:    options.Split,
+		rng:      rand.New(rand.NewSource(options.seed())),
+		workers:  options.workers(),
+		progress: options.Progress,
+	}
+}
+
+// derive ... returns a builder with the same settings, seeded from the random source of b
+func (b *builder) derive() *builder {
+	derived := *b
+	derived.rng = rand.New(rand.NewSource(b.rng.Int63()))
+	return &derived
+}
+
+// buildRun holds the state shared by the goroutines building the trees of an index
+type buildRun struct {
+	ctx context.Context
+	// workers ... semaphore bounding the number of goroutines building nodes
+	workers chan struct{}
+
+	progress   func(Progress)
+	progressMu sync.Mutex
+	trees      int
+	treesDone  int
+	nodesBuilt int64
+}
+
+// buildTrees ... builds the trees in parallel, each one with its own builder seeded from b,
+// using at most b.workers goroutines and stopping early if ctx is done
+func buildTrees(ctx context.Context, dataItems []*dataItem, numberOfTrees int, b *builder) ([]*node, error) {
+	run := &buildRun{
+		ctx:      ctx,
+		workers:  make(chan struct{}, b.workers),
+		progress: b.progress,
+		trees:    numberOfTrees,
+	}
+
+	// derive the builders up front, so that every tree gets the same seed whatever the scheduling
+	trees := make([]*node, numberOfTrees)
+	builders := make([]*builder, numberOfTrees)
+	for t := range builders {
+		builders[t] = b.derive()
+		builders[t].run = run
+	}
+
+	// build multiple trees in parallel
+	var wg sync.WaitGroup
+	errs := make([]error, numberOfTrees)
+	for t := range trees {
+		if err := run.acquire(); err != nil {
+			errs[t] = err
+			break
+		}
+		wg.Add(1)
+		go func(t int) {
+			defer wg.Done()
+			defer run.release()
+			root := NewNode(dataItems, builders[t])
+			if errs[t] = root.build(dataItems, builders[t]); errs[t] == nil {
+				trees[t] = root
+				run.treeDone()
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return trees, nil
+}
+
+// acquire ... waits for a worker to be available
+func (r *buildRun) acquire() error {
+	select {
+	case r.workers <- struct{}{}:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// tryAcquire ... returns whether a worker was available, without waiting
+func (r *buildRun) tryAcquire() bool {
+	if r == nil {
+		return false
+	}
+	select {
+	case r.workers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *buildRun) release() {
+	<-r.workers
+}
+
+// nodeBuilt ... counts a node and reports the progress every progressInterval nodes,
+// it returns an error if the build was cancelled
+func (r *buildRun) nodeBuilt() error {
+	if r == nil {
+		return nil
+	}
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if n := atomic.AddInt64(&r.nodesBuilt, 1); n%progressInterval == 0 {
+		r.report(false)
+	}
+	return nil
+}
+
+func (r *buildRun) treeDone() {
+	r.report(true)
+}
+
+// report ... calls the progress callback, one call at a time
+func (r *buildRun) report(treeDone bool) {
+	if r.progress == nil && !treeDone {
+		return
+	}
+	r.progressMu.Lock()
+	defer r.progressMu.Unlock()
+	if treeDone {
+		r.treesDone++
+	}
+	if r.progress != nil {
+		r.progress(Progress{Trees: r.trees, TreesDone: r.treesDone, NodesBuilt: atomic.LoadInt64(&r.nodesBuilt)})
+	}
+}
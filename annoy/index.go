@@ -1,124 +1,307 @@
+// Package annoy implements approximate nearest neighbours search over a forest of random projection trees,
+// which can be saved to disk and memory-mapped.
+//
+// Builds are randomised: unless Options.Seed is set to a non-zero value, every build is seeded from the
+// current time (see RandomSeed), so two builds over the same items produce different trees and may return
+// different neighbours. Set a seed to make builds reproducible.
 package annoy
 
 import (
-	"container/heap"
+	"context"
 	"errors"
 	"fmt"
-	"math"
+	"io"
 	"sort"
 	"sync"
-	"time"
-
-	"github.com/pilillo/apostasi/common"
 )
 
+// Index is an approximate nearest neighbours index over a forest of random projection trees.
+// All methods are safe for concurrent use by multiple goroutines: queries run in parallel with each other,
+// while Add and Remove wait for the running queries and hold them off only for the time of a single insertion.
+// Compact builds the new trees without blocking queries nor mutations.
 type Index interface {
+	// FindSimilarById ... same as FindSimilarByVector, using the vector of the item with the given id as query
 	FindSimilarById(id int64, k int, bucketScale float64) (neighbours []int64, err error)
+	// FindSimilarByVector ... returns the ids of the k nearest neighbours of v, inspecting the trees until
+	// k * bucketScale distinct candidates are found, see Search for a budget that does not depend on k
 	FindSimilarByVector(v []float64, k int, bucketScale float64) (neighbours []int64, err error)
+	// FindNeighborsById ... same as FindSimilarById, also returning the distance of every neighbour
+	FindNeighborsById(id int64, k int, bucketScale float64) (neighbours []Neighbor, err error)
+	// FindNeighborsByVector ... same as FindSimilarByVector, also returning the distance of every neighbour
+	FindNeighborsByVector(v []float64, k int, bucketScale float64) (neighbours []Neighbor, err error)
+	// Search ... returns the k nearest neighbours of v, inspecting the trees as set by opts
+	Search(v []float64, k int, opts SearchOptions) (neighbours []Neighbor, err error)
+	// SearchById ... same as Search, using the vector of the item with the given id as query
+	SearchById(id int64, k int, opts SearchOptions) (neighbours []Neighbor, err error)
+	// FindSimilarBatch ... runs Search for every vector in parallel, returning the neighbours in the order of vectors
+	FindSimilarBatch(vectors [][]float64, k int, opts SearchOptions) (neighbours [][]Neighbor, err error)
+	// FindWithinDistance ... returns all the neighbours up to maxDist from v, sorted by distance, among the
+	// ones found inspecting searchK nodes (a non-positive searchK inspects numberOfTrees * k nodes, k being the leaf size)
+	FindWithinDistance(v []float64, maxDist float64, searchK int) (neighbours []Neighbor, err error)
 	SortCandidates(idToDistance map[int64]float64) ([]int64, error)
+	// Save ... writes the index to w, it can be read back with Load
+	Save(w io.Writer) error
+	// Add ... inserts a new item in all trees, splitting the leaves that exceed k items
+	Add(id int64, vector []float64) error
+	// Remove ... marks an item as deleted, so that it is no longer returned by queries
+	Remove(id int64) error
+	// Compact ... rebuilds the trees from the items that were not removed
+	Compact() error
 }
 
 type index struct {
 	// k ... num items in a leaf node
 	k    int
 	size int
+	// metric ... distance used to split the nodes and to rank the neighbours
+	metric Metric
+	// builder ... used to split the leaves grown by Add, it is guarded by mu like the trees
+	builder *builder
 	// trees ... trees indices
 	trees []*node
 	// nodes ... maps node ids to actual nodes that can be traversed
 	nodes map[nodeId]*node
 	// items ... maps item ids to actual items (i.e., index+vector pairs)
 	items map[dataItemId]*dataItem
+	// deleted ... tombstones of the removed items, which are still referenced by the trees until compaction
+	deleted map[dataItemId]struct{}
+
+	// mu ... guards trees, nodes, items and deleted: queries hold it for reading, mutations for writing
+	mu sync.RWMutex
+	// compacting ... serializes calls to Compact
+	compacting sync.Mutex
 }
 
 func (i *index) FindSimilarById(id int64, k int, bucketScale float64) ([]int64, error) {
-	it, ok := i.items[dataItemId(id)]
+	neighbours, err := i.FindNeighborsById(id, k, bucketScale)
+	if err != nil {
+		return nil, err
+	}
+	return neighbourIds(neighbours), nil
+}
+
+func (i *index) FindSimilarByVector(v []float64, k int, bucketScale float64) ([]int64, error) {
+	neighbours, err := i.FindNeighborsByVector(v, k, bucketScale)
+	if err != nil {
+		return nil, err
+	}
+	return neighbourIds(neighbours), nil
+}
+
+func (i *index) FindNeighborsById(id int64, k int, bucketScale float64) ([]Neighbor, error) {
+	v, err := i.itemVector(id)
+	if err != nil {
+		return nil, err
+	}
+	return i.FindNeighborsByVector(v, k, bucketScale)
+}
+
+func (i *index) FindNeighborsByVector(v []float64, k int, bucketScale float64) ([]Neighbor, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return findNeighbors[nodeId](i, i.metric, v, k, bucketScale)
+}
+
+func (i *index) Search(v []float64, k int, opts SearchOptions) ([]Neighbor, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return search[nodeId](i, i.metric, v, k, opts.searchK(k, len(i.trees)), opts.Filter)
+}
+
+func (i *index) SearchById(id int64, k int, opts SearchOptions) ([]Neighbor, error) {
+	v, err := i.itemVector(id)
+	if err != nil {
+		return nil, err
+	}
+	return i.Search(v, k, opts)
+}
+
+func (i *index) FindSimilarBatch(vectors [][]float64, k int, opts SearchOptions) ([][]Neighbor, error) {
+	return searchBatch(vectors, opts.workers(), func(v []float64) ([]Neighbor, error) {
+		return i.Search(v, k, opts)
+	})
+}
+
+func (i *index) FindWithinDistance(v []float64, maxDist float64, searchK int) ([]Neighbor, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if searchK <= 0 {
+		searchK = len(i.trees) * i.k
+	}
+	return findWithinDistance[nodeId](i, i.metric, v, maxDist, searchK)
+}
+
+// itemVector ... returns the vector of the item with the given id
+func (i *index) itemVector(id int64) ([]float64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	it, ok := i.lookup(dataItemId(id))
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("No item found for id: %d", id))
 	}
-	return i.FindSimilarByVector(it.vector, k, bucketScale)
+	return it.vector, nil
 }
 
-func (i *index) FindSimilarByVector(v []float64, k int, bucketScale float64) (neighbours []int64, err error) {
-	// 1. init priority queue and insert the root nodes of all trees
-	pq := priorityQueue{}
-	for i, r := range i.trees {
-		n := &queueItem{
-			value:    r.id,
-			index:    i,
-			priority: math.Inf(-1),
-		}
-		pq = append(pq, n)
+// lookup ... returns an item unless it was removed
+func (i *index) lookup(id dataItemId) (*dataItem, bool) {
+	it, ok := i.items[id]
+	if !ok {
+		return nil, false
+	}
+	if _, removed := i.deleted[id]; removed {
+		return nil, false
 	}
+	return it, true
+}
 
-	bucketSize := int(float64(k) * bucketScale)
-	annMap := make(map[dataItemId]struct{}, bucketSize)
+func (i *index) Add(id int64, vector []float64) error {
+	if len(vector) != i.size {
+		return fmt.Errorf("item %d has dimension %d, expected %d", id, len(vector), i.size)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-	// 2. search for candidates in all trees
-	heap.Init(&pq)
-	for pq.Len() > 0 && len(annMap) < bucketSize {
-		q, ok := heap.Pop(&pq).(*queueItem)
-		d := q.priority
-		n, ok := i.nodes[q.value]
-		if !ok {
-			return nil, errors.New("invalid index")
+	iid := dataItemId(id)
+	if old, exists := i.items[iid]; exists {
+		if _, removed := i.deleted[iid]; !removed {
+			return fmt.Errorf("item %d already exists", id)
 		}
-
-		if len(n.leafItems) > 0 {
-			for _, id := range n.leafItems {
-				annMap[id] = struct{}{}
-			}
-			continue
+		// the item is being re-added, drop the references left by its previous version
+		for _, tr := range i.trees {
+			tr.remove(old)
 		}
+		delete(i.deleted, iid)
+	}
+
+	it := &dataItem{id: iid, vector: vector}
+	i.items[iid] = it
+	for _, tr := range i.trees {
+		i.registerAll(tr.insert(it, i.items, i.builder))
+	}
+	return nil
+}
+
+func (i *index) Remove(id int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	iid := dataItemId(id)
+	if _, ok := i.lookup(iid); !ok {
+		return fmt.Errorf("no item found for id: %d", id)
+	}
+	i.deleted[iid] = struct{}{}
+	return nil
+}
+
+// Compact rebuilds all trees from the live items, dropping the tombstones left by Remove and
+// re-balancing the leaves grown by Add. The trees are built without holding the index lock,
+// so it can run in the background while the index keeps serving queries and mutations.
+func (i *index) Compact() error {
+	i.compacting.Lock()
+	defer i.compacting.Unlock()
 
-		dp := calculateDirection(n.split, v)
-		heap.Push(&pq, &queueItem{
-			value:    n.leftChild.id,
-			priority: math.Max(d, dp),
-		})
-		heap.Push(&pq, &queueItem{
-			value:    n.rightChild.id,
-			priority: math.Max(d, -dp),
-		})
-	}
-
-	// 3. calculate cross-similarity between query vector v and all candidates
-	idToDist := make(map[int64]float64, len(annMap))
-	//candidates := make([]int64, 0, len(annMap))
-	for id := range annMap {
-		iid := int64(id)
-		//candidates = append(candidates, iid)
-		if idToDist[iid], err = common.CosineDistance(i.items[id].vector, v); err != nil {
-			return nil, err
+	// 1. snapshot the live items
+	i.mu.RLock()
+	snapshot := make(map[dataItemId]*dataItem, len(i.items)-len(i.deleted))
+	for id := range i.items {
+		if it, ok := i.lookup(id); ok {
+			snapshot[id] = it
 		}
 	}
+	numberOfTrees := len(i.trees)
+	// the random source is only used by the writers, which are excluded by the read lock, and by Compact itself
+	b := i.builder.derive()
+	i.mu.RUnlock()
 
-	// 3. sort candidates by distance asc
-	candidates, err := i.SortCandidates(idToDist)
+	// 2. build the new trees from the snapshot
+	dataItems := make([]*dataItem, 0, len(snapshot))
+	for _, it := range snapshot {
+		dataItems = append(dataItems, it)
+	}
+	sort.Slice(dataItems, func(a, b int) bool { return dataItems[a].id < dataItems[b].id })
+	trees, err := buildTrees(context.Background(), dataItems, numberOfTrees, b)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// 3. replay the mutations that happened in the meantime and swap the trees
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	items := make(map[dataItemId]*dataItem, len(snapshot))
+	for id, it := range snapshot {
+		items[id] = it
+	}
+	for id, it := range snapshot {
+		if current, ok := i.lookup(id); !ok || current != it {
+			for _, tr := range trees {
+				tr.remove(it)
+			}
+			delete(items, id)
+		}
+	}
+	for id := range i.items {
+		current, ok := i.lookup(id)
+		if !ok || snapshot[id] == current {
+			continue
+		}
+		items[id] = current
+		for _, tr := range trees {
+			tr.insert(current, items, i.builder)
+		}
 	}
 
-	// 4. return top k
-	if len(candidates) > k {
-		candidates = candidates[:k]
+	i.trees = trees
+	i.items = items
+	i.deleted = map[dataItemId]struct{}{}
+	i.nodes = make(map[nodeId]*node, len(i.nodes))
+	for _, tr := range trees {
+		i.registerAll(tr)
 	}
-	return candidates, nil
+	return nil
 }
 
 func (i *index) SortCandidates(idToDistance map[int64]float64) ([]int64, error) {
-	candidates := make([]int64, 0, len(idToDistance))
+	return sortCandidates(idToDistance), nil
+}
 
-	for id := range idToDistance {
-		iid := int64(id)
-		candidates = append(candidates, iid)
+func (i *index) roots() []nodeId {
+	roots := make([]nodeId, len(i.trees))
+	for t, r := range i.trees {
+		roots[t] = r.id
 	}
+	return roots
+}
 
-	// sort candidates by descending similarity / ascending distance
-	sort.SliceStable(candidates, func(i, j int) bool {
-		return idToDistance[candidates[i]] < idToDistance[candidates[j]]
-	})
+func (i *index) visit(id nodeId) (split []float64, offset float64, left, right nodeId, items []int64, leaf bool, err error) {
+	n, ok := i.nodes[id]
+	if !ok {
+		err = errors.New("invalid index")
+		return
+	}
+	if n.leftChild == nil || n.rightChild == nil {
+		items = make([]int64, 0, len(n.leafItems))
+		for _, item := range n.leafItems {
+			if _, removed := i.deleted[item]; !removed {
+				items = append(items, int64(item))
+			}
+		}
+		leaf = true
+		return
+	}
+	return n.split, n.offset, n.leftChild.id, n.rightChild.id, nil, false, nil
+}
 
-	return candidates, nil
+func (i *index) vector(item int64) ([]float64, error) {
+	it, ok := i.items[dataItemId(item)]
+	if !ok {
+		return nil, fmt.Errorf("no item found for id: %d", item)
+	}
+	return it.vector, nil
+}
+
+func (i *index) id(item int64) int64 {
+	return item
 }
 
 type dataItemId int64
@@ -145,48 +328,110 @@ func dataItemsFromRawData(rawData [][]float64) ([]*dataItem, map[dataItemId]*dat
 	return dataItems, indexedDataItems
 }
 
-func NewIndex(rawData [][]float64, size int, numberOfTrees int, k int) (Index, error) {
+// Item is a vector identified by a caller-supplied id
+type Item struct {
+	ID     int64
+	Vector []float64
+}
+
+func dataItemsFromItems(items []Item, size int) ([]*dataItem, map[dataItemId]*dataItem, error) {
+	dataItems := make([]*dataItem, len(items))
+	indexedDataItems := make(map[dataItemId]*dataItem, len(items))
+	for i, it := range items {
+		if len(it.Vector) != size {
+			return nil, nil, fmt.Errorf("item %d has dimension %d, expected %d", it.ID, len(it.Vector), size)
+		}
+		if _, exists := indexedDataItems[dataItemId(it.ID)]; exists {
+			return nil, nil, fmt.Errorf("duplicate item id %d", it.ID)
+		}
+		dataItems[i] = &dataItem{id: dataItemId(it.ID), vector: it.Vector}
+		indexedDataItems[dataItems[i].id] = dataItems[i]
+	}
+	return dataItems, indexedDataItems, nil
+}
+
+// NewIndex builds an index over rawData, items are identified by their position in rawData
+func NewIndex(rawData [][]float64, size int, numberOfTrees int, k int, opts ...Options) (Index, error) {
+	options, err := optionsOf(opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// convert the input matrix to indexed data items so that they can be moved around properly
 	dataItems, indexedDataItems := dataItemsFromRawData(rawData)
 
-	index := &index{
-		k:     k,
-		size:  size,
-		trees: make([]*node, numberOfTrees),
-		nodes: map[nodeId]*node{}, // map nodeId to node
-		items: indexedDataItems,   // map dataItemId to dataItem
+	index, err := newIndex(context.Background(), dataItems, indexedDataItems, size, numberOfTrees, k, options)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// NewIndexFromItems builds an index over items identified by their ID, so that the ids returned
+// by queries do not depend on the order of the items
+func NewIndexFromItems(items []Item, size int, numberOfTrees int, k int, opts ...Options) (Index, error) {
+	return NewIndexContext(context.Background(), items, size, numberOfTrees, k, opts...)
+}
+
+// NewIndexContext is the same as NewIndexFromItems, but stops building the trees and returns
+// the error of ctx as soon as ctx is done
+func NewIndexContext(ctx context.Context, items []Item, size int, numberOfTrees int, k int, opts ...Options) (Index, error) {
+	options, err := optionsOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	dataItems, indexedDataItems, err := dataItemsFromItems(items, size)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newIndex(ctx, dataItems, indexedDataItems, size, numberOfTrees, k, options)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// NewIndexFromMap builds an index over the vectors of data, identified by their key
+func NewIndexFromMap(data map[int64][]float64, size int, numberOfTrees int, k int, opts ...Options) (Index, error) {
+	items := make([]Item, 0, len(data))
+	for id, v := range data {
+		items = append(items, Item{ID: id, Vector: v})
 	}
+	// sort the items so that the build does not depend on the map iteration order
+	sort.Slice(items, func(a, b int) bool { return items[a].ID < items[b].ID })
+	return NewIndexFromItems(items, size, numberOfTrees, k, opts...)
+}
 
-	// init trees
-	for t := 0; t < numberOfTrees; t++ {
-		root := NewNode(dataItems)
+func newIndex(ctx context.Context, dataItems []*dataItem, indexedDataItems map[dataItemId]*dataItem, size int, numberOfTrees int, k int, options Options) (*index, error) {
+	index := &index{
+		k:       k,
+		size:    size,
+		metric:  options.Metric,
+		builder: newBuilder(k, options),
+		nodes:   map[nodeId]*node{},        // map nodeId to node
+		items:   indexedDataItems,          // map dataItemId to dataItem
+		deleted: map[dataItemId]struct{}{}, // set of removed dataItemIds
+	}
 
-		index.trees[t] = root
-		index.nodes[root.id] = root
+	trees, err := buildTrees(ctx, dataItems, numberOfTrees, index.builder)
+	if err != nil {
+		return nil, err
 	}
+	index.trees = trees
 
-	// build multiple trees in parallel
-	var wg sync.WaitGroup
-	wg.Add(numberOfTrees)
+	// register all nodes so that they can be looked up while traversing the trees
 	for _, treeRoot := range index.trees {
-		go func(tr *node, k int) {
-			defer wg.Done()
-			tr.build(dataItems, k)
-		}(treeRoot, k)
+		index.registerAll(treeRoot)
 	}
-	wg.Wait()
 	return index, nil
 }
 
-func getSplit(dataItems []*dataItem) []float64 {
-	seed := time.Now().UnixNano()
-	centroids, _ := common.KMeans(seed, rawDataFromDataItems(dataItems), 2, 200, common.EuclideanSimilarity[float64])
-
-	split := make([]float64, len(centroids[0]))
-	for d := 0; d < len(centroids[0]); d++ {
-		v := centroids[0][d] - centroids[1][d]
-		split[d] += v
+// registerAll ... registers a node and all its descendants
+func (i *index) registerAll(n *node) {
+	if n == nil {
+		return
 	}
-	return split
+	i.nodes[n.id] = n
+	i.registerAll(n.leftChild)
+	i.registerAll(n.rightChild)
 }
@@ -0,0 +1,103 @@
+package annoy
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pilillo/apostasi/common"
+)
+
+// Metric is the distance used to build the trees of an index and to rank the neighbours it returns
+type Metric uint32
+
+const (
+	// Angular ... cosine distance, i.e. 1 - cos(x, y)
+	Angular Metric = iota
+	// Euclidean ... L2 distance
+	Euclidean
+	// Manhattan ... L1 distance
+	Manhattan
+	// Dot ... negated inner product, so that items with a larger inner product are closer
+	Dot
+	// Hamming ... number of differing components, meant for binary vectors
+	Hamming
+)
+
+func (m Metric) String() string {
+	switch m {
+	case Angular:
+		return "angular"
+	case Euclidean:
+		return "euclidean"
+	case Manhattan:
+		return "manhattan"
+	case Dot:
+		return "dot"
+	case Hamming:
+		return "hamming"
+	default:
+		return fmt.Sprintf("Metric(%d)", uint32(m))
+	}
+}
+
+func (m Metric) validate() error {
+	if m > Hamming {
+		return fmt.Errorf("unknown metric %d", uint32(m))
+	}
+	return nil
+}
+
+// distance ... returns the distance between two vectors, used to rank the candidates
+func (m Metric) distance(v1, v2 []float64) (float64, error) {
+	switch m {
+	case Euclidean:
+		return common.EuclideanDistance(v1, v2)
+	case Manhattan:
+		return common.ManhattanDistance(v1, v2)
+	case Dot:
+		dot, err := common.Dot(v1, v2)
+		return -dot, err
+	case Hamming:
+		return common.HammingDistance(v1, v2)
+	default:
+		return common.CosineDistance(v1, v2)
+	}
+}
+
+// similarity ... returns the similarity measure used to cluster the items of a node into two sides
+func (m Metric) similarity() func([]float64, []float64) (float64, error) {
+	switch m {
+	case Euclidean:
+		return common.EuclideanSimilarity[float64]
+	case Manhattan, Hamming:
+		distance := m.distance
+		return func(v1, v2 []float64) (float64, error) {
+			d, err := distance(v1, v2)
+			return 1.0 / (1.0 + d), err
+		}
+	default:
+		return common.Cosine[float64]
+	}
+}
+
+// normalized ... returns whether the items are compared by direction only when splitting,
+// which is the case for the angular and the inner product metrics
+func (m Metric) normalized() bool {
+	return m == Angular || m == Dot
+}
+
+func normalize(v []float64) []float64 {
+	norm := 0.0
+	for _, x := range v {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return v
+	}
+	n := make([]float64, len(v))
+	for i, x := range v {
+		n[i] = x / norm
+	}
+	return n
+}
@@ -0,0 +1,348 @@
+package annoy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+)
+
+// MmapIndex is a read-only index served directly from a file written by Index.Save.
+// The file is memory-mapped, so that multiple processes on the same host share it through the page cache.
+// Queries are safe for concurrent use, but must not run concurrently with Close.
+type MmapIndex interface {
+	Index
+	// Close ... unmaps the index file, the index must not be used afterwards
+	Close() error
+}
+
+var errReadOnly = errors.New("memory-mapped indexes are read-only")
+
+type mmapIndex struct {
+	data   []byte
+	header fileHeader
+	unmap  func() error
+
+	// offsets of the sections within data
+	rootsOffset  int
+	idsOffset    int
+	dataOffset   int
+	nodesOffset  int
+	leavesOffset int
+	// nodeSize ... size in bytes of a node record including its split
+	nodeSize int
+}
+
+// OpenMmap memory-maps an index file previously written with Index.Save
+func OpenMmap(path string) (MmapIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, unmap, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("mapping %s: %w", path, err)
+	}
+
+	idx, err := newMmapIndex(data, unmap)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func newMmapIndex(data []byte, unmap func() error) (*mmapIndex, error) {
+	headerSize := binary.Size(fileHeader{})
+	if len(data) < headerSize {
+		return nil, errors.New("reading index header: file too short")
+	}
+	idx := &mmapIndex{data: data, unmap: unmap}
+	if err := binary.Read(bytes.NewReader(data[:headerSize]), byteOrder, &idx.header); err != nil {
+		return nil, fmt.Errorf("reading index header: %w", err)
+	}
+	if err := idx.header.validate(); err != nil {
+		return nil, err
+	}
+
+	// compute the section offsets and make sure they match the file size,
+	// in checked arithmetic since a corrupt header could make them overflow
+	h := idx.header
+	dim := uint64(h.Dim)
+	nodeSize := uint64(binary.Size(nodeRecord{})) + 8 + 8*dim
+	size, overflow := uint64(headerSize), false
+	section := func(count uint64, width uint64) int {
+		offset := size
+		hi, length := bits.Mul64(count, width)
+		var carry uint64
+		size, carry = bits.Add64(size, length, 0)
+		overflow = overflow || hi != 0 || carry != 0
+		return int(offset)
+	}
+	idx.rootsOffset = section(uint64(h.NumTrees), 4)
+	idx.idsOffset = section(h.NumItems, 8)
+	idx.dataOffset = section(h.NumItems, 8*dim)
+	idx.nodesOffset = section(h.NumNodes, nodeSize)
+	idx.leavesOffset = section(h.NumLeafRefs, 4)
+	if overflow {
+		return nil, errors.New("invalid index size, the sections overflow")
+	}
+	if size != uint64(len(data)) {
+		return nil, fmt.Errorf("invalid index size %d bytes, expected %d", len(data), size)
+	}
+	idx.nodeSize = int(nodeSize)
+
+	// item ids are written in ascending order, which allows looking them up with a binary search
+	for p := 1; p < int(h.NumItems); p++ {
+		if idx.itemId(p-1) >= idx.itemId(p) {
+			return nil, fmt.Errorf("item ids are not sorted at position %d", p)
+		}
+	}
+	if err := idx.validateTrees(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// validateTrees ... walks every tree once, as Load does, so that queries never loop over a corrupt file
+func (i *mmapIndex) validateTrees() error {
+	h := i.header
+	visited := make([]bool, h.NumNodes)
+	for t, r := range i.roots() {
+		stack := []uint32{r}
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if uint64(n) >= h.NumNodes {
+				return fmt.Errorf("invalid tree %d: node %d out of range", t, n)
+			}
+			if visited[n] {
+				return fmt.Errorf("invalid tree %d: node %d is referenced more than once", t, n)
+			}
+			visited[n] = true
+
+			rec := i.record(n)
+			if rec.Left != noChild && rec.Right != noChild {
+				stack = append(stack, rec.Right, rec.Left)
+				continue
+			}
+			if rec.Left != rec.Right {
+				return fmt.Errorf("invalid tree %d: node %d has a single child", t, n)
+			}
+			if uint64(rec.LeafStart)+uint64(rec.LeafCount) > h.NumLeafRefs {
+				return fmt.Errorf("invalid tree %d: leaf %d out of range", t, n)
+			}
+			for j := uint64(0); j < uint64(rec.LeafCount); j++ {
+				if pos := i.leafItem(uint64(rec.LeafStart) + j); uint64(pos) >= h.NumItems {
+					return fmt.Errorf("invalid tree %d: leaf %d references unknown item position %d", t, n, pos)
+				}
+			}
+		}
+	}
+	for n, ok := range visited {
+		if !ok {
+			return fmt.Errorf("node %d is not reachable from any tree", n)
+		}
+	}
+	return nil
+}
+
+func (i *mmapIndex) Close() error {
+	if i.unmap == nil {
+		return nil
+	}
+	err := i.unmap()
+	i.unmap = nil
+	i.data = nil
+	return err
+}
+
+func (i *mmapIndex) FindSimilarById(id int64, k int, bucketScale float64) ([]int64, error) {
+	neighbours, err := i.FindNeighborsById(id, k, bucketScale)
+	if err != nil {
+		return nil, err
+	}
+	return neighbourIds(neighbours), nil
+}
+
+func (i *mmapIndex) FindSimilarByVector(v []float64, k int, bucketScale float64) ([]int64, error) {
+	neighbours, err := i.FindNeighborsByVector(v, k, bucketScale)
+	if err != nil {
+		return nil, err
+	}
+	return neighbourIds(neighbours), nil
+}
+
+func (i *mmapIndex) FindNeighborsById(id int64, k int, bucketScale float64) ([]Neighbor, error) {
+	v, err := i.itemVector(id)
+	if err != nil {
+		return nil, err
+	}
+	return i.FindNeighborsByVector(v, k, bucketScale)
+}
+
+func (i *mmapIndex) FindNeighborsByVector(v []float64, k int, bucketScale float64) ([]Neighbor, error) {
+	if i.data == nil {
+		return nil, errors.New("index is closed")
+	}
+	return findNeighbors[uint32](i, Metric(i.header.Metric), v, k, bucketScale)
+}
+
+func (i *mmapIndex) Search(v []float64, k int, opts SearchOptions) ([]Neighbor, error) {
+	if i.data == nil {
+		return nil, errors.New("index is closed")
+	}
+	return search[uint32](i, Metric(i.header.Metric), v, k, opts.searchK(k, int(i.header.NumTrees)), opts.Filter)
+}
+
+func (i *mmapIndex) SearchById(id int64, k int, opts SearchOptions) ([]Neighbor, error) {
+	v, err := i.itemVector(id)
+	if err != nil {
+		return nil, err
+	}
+	return i.Search(v, k, opts)
+}
+
+func (i *mmapIndex) FindSimilarBatch(vectors [][]float64, k int, opts SearchOptions) ([][]Neighbor, error) {
+	return searchBatch(vectors, opts.workers(), func(v []float64) ([]Neighbor, error) {
+		return i.Search(v, k, opts)
+	})
+}
+
+func (i *mmapIndex) FindWithinDistance(v []float64, maxDist float64, searchK int) ([]Neighbor, error) {
+	if i.data == nil {
+		return nil, errors.New("index is closed")
+	}
+	if searchK <= 0 {
+		searchK = int(i.header.NumTrees) * int(i.header.LeafSize)
+	}
+	return findWithinDistance[uint32](i, Metric(i.header.Metric), v, maxDist, searchK)
+}
+
+func (i *mmapIndex) SortCandidates(idToDistance map[int64]float64) ([]int64, error) {
+	return sortCandidates(idToDistance), nil
+}
+
+// Save writes the mapped file as is, since it is already in the Save format
+func (i *mmapIndex) Save(w io.Writer) error {
+	if i.data == nil {
+		return errors.New("index is closed")
+	}
+	_, err := w.Write(i.data)
+	return err
+}
+
+func (i *mmapIndex) roots() []uint32 {
+	roots := make([]uint32, i.header.NumTrees)
+	for t := range roots {
+		roots[t] = byteOrder.Uint32(i.data[i.rootsOffset+4*t:])
+	}
+	return roots
+}
+
+func (i *mmapIndex) visit(n uint32) (split []float64, offset float64, left, right uint32, items []int64, leaf bool, err error) {
+	if uint64(n) >= i.header.NumNodes {
+		err = errors.New("invalid index")
+		return
+	}
+	position := i.nodesOffset + int(n)*i.nodeSize
+	rec := i.record(n)
+
+	if rec.Left == noChild || rec.Right == noChild {
+		if uint64(rec.LeafStart)+uint64(rec.LeafCount) > i.header.NumLeafRefs {
+			err = errors.New("invalid index")
+			return
+		}
+		items = make([]int64, rec.LeafCount)
+		for j := range items {
+			items[j] = int64(i.leafItem(uint64(rec.LeafStart) + uint64(j)))
+		}
+		leaf = true
+		return
+	}
+	position += binary.Size(nodeRecord{})
+	offset = math.Float64frombits(byteOrder.Uint64(i.data[position:]))
+	return i.floats(position+8, int(i.header.Dim)), offset, rec.Left, rec.Right, nil, false, nil
+}
+
+// record ... decodes the record of a node, n must be in range
+func (i *mmapIndex) record(n uint32) nodeRecord {
+	position := i.nodesOffset + int(n)*i.nodeSize
+	return nodeRecord{
+		Left:      byteOrder.Uint32(i.data[position:]),
+		Right:     byteOrder.Uint32(i.data[position+4:]),
+		LeafStart: byteOrder.Uint32(i.data[position+8:]),
+		LeafCount: byteOrder.Uint32(i.data[position+12:]),
+	}
+}
+
+// leafItem ... returns the item position stored at index j of the leaves section
+func (i *mmapIndex) leafItem(j uint64) uint32 {
+	return byteOrder.Uint32(i.data[i.leavesOffset+4*int(j):])
+}
+
+// vector ... items referenced by the leaves of a mapped index are positions in the ids and data sections
+func (i *mmapIndex) vector(item int64) ([]float64, error) {
+	if item < 0 || uint64(item) >= i.header.NumItems {
+		return nil, fmt.Errorf("no item found at position: %d", item)
+	}
+	dim := int(i.header.Dim)
+	return i.floats(i.dataOffset+8*dim*int(item), dim), nil
+}
+
+func (i *mmapIndex) id(item int64) int64 {
+	return i.itemId(int(item))
+}
+
+// itemVector ... returns the vector of the item with the given id
+func (i *mmapIndex) itemVector(id int64) ([]float64, error) {
+	if i.data == nil {
+		return nil, errors.New("index is closed")
+	}
+	p, ok := i.position(id)
+	if !ok {
+		return nil, fmt.Errorf("No item found for id: %d", id)
+	}
+	return i.vector(int64(p))
+}
+
+func (i *mmapIndex) itemId(p int) int64 {
+	return int64(byteOrder.Uint64(i.data[i.idsOffset+8*p:]))
+}
+
+func (i *mmapIndex) position(id int64) (int, bool) {
+	n := int(i.header.NumItems)
+	p := sort.Search(n, func(p int) bool { return i.itemId(p) >= id })
+	return p, p < n && i.itemId(p) == id
+}
+
+func (i *mmapIndex) floats(offset int, n int) []float64 {
+	v := make([]float64, n)
+	for j := range v {
+		v[j] = math.Float64frombits(byteOrder.Uint64(i.data[offset+8*j:]))
+	}
+	return v
+}
+
+func (i *mmapIndex) Add(id int64, vector []float64) error {
+	return errReadOnly
+}
+
+func (i *mmapIndex) Remove(id int64) error {
+	return errReadOnly
+}
+
+func (i *mmapIndex) Compact() error {
+	return errReadOnly
+}
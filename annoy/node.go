@@ -1,23 +1,36 @@
 package annoy
 
-import "github.com/google/uuid"
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
 
 type nodeId string
 
 type node struct {
 	id nodeId
 
+	// split, offset ... hyperplane dot(split, v) + offset = 0 separating the children
 	split      []float64
+	offset     float64
 	leftChild  *node
 	rightChild *node
 
 	leafItems []dataItemId
+	// splitAt ... number of items a leaf must reach before Add tries to split it again,
+	// after a split that left it unbalanced
+	splitAt int
 }
 
-func NewNode(dataItems []*dataItem) *node {
+func NewNode(dataItems []*dataItem, b *builder) *node {
+	split, offset := getSplit(dataItems, b)
+	// draw the node id from the random source too, so that seeded builds are reproducible
+	id, _ := uuid.NewRandomFromReader(b.rng)
 	return &node{
-		id:    nodeId(uuid.New().String()),
-		split: getSplit(dataItems),
+		id:     nodeId(id.String()),
+		split:  split,
+		offset: offset,
 
 		leftChild:  nil,
 		rightChild: nil,
@@ -26,39 +39,76 @@ func NewNode(dataItems []*dataItem) *node {
 	}
 }
 
-func (n *node) build(dataItems []*dataItem, k int) {
+func (n *node) build(dataItems []*dataItem, b *builder) error {
+	if err := b.run.nodeBuilt(); err != nil {
+		return err
+	}
+
 	// base case, the node is a leaf has items are less than k
-	if len(dataItems) <= k {
+	if len(dataItems) <= b.k {
 		n.leafItems = make([]dataItemId, len(dataItems))
 		for i, dataItem := range dataItems {
 			n.leafItems[i] = dataItem.id
 		}
-	} else {
-		// inductive case, the node must be split into its children
-		leftItems := []*dataItem{}
-		rightItems := []*dataItem{}
-		for _, dataItem := range dataItems {
-			if calculateDirection(dataItem.vector, n.split) > 0 {
-				rightItems = append(rightItems, dataItem)
-			} else {
-				leftItems = append(leftItems, dataItem)
-			}
-		}
-		// avoid splitting too much on a side only unless the split is greater than the min k size
-		if len(leftItems) <= k || len(rightItems) <= k {
-			n.leafItems = make([]dataItemId, len(dataItems))
-			for i, dataItem := range dataItems {
-				n.leafItems[i] = dataItem.id
-			}
+		return nil
+	}
+
+	// inductive case, the node must be split into its children
+	leftItems := []*dataItem{}
+	rightItems := []*dataItem{}
+	for _, dataItem := range dataItems {
+		if n.direction(dataItem.vector) > 0 {
+			rightItems = append(rightItems, dataItem)
 		} else {
-			// build left child
-			n.leftChild = NewNode(leftItems)
-			n.leftChild.build(leftItems, k)
-			// build right child
-			n.rightChild = NewNode(rightItems)
-			n.rightChild.build(rightItems, k)
+			leftItems = append(leftItems, dataItem)
+		}
+	}
+	// avoid splitting too much on a side only unless the split is greater than the min k size
+	if len(leftItems) <= b.k || len(rightItems) <= b.k {
+		n.leafItems = make([]dataItemId, len(dataItems))
+		for i, dataItem := range dataItems {
+			n.leafItems[i] = dataItem.id
 		}
+		return nil
+	}
+
+	// the node becomes an inner node, its items are moved to the children
+	n.leafItems = nil
+
+	// every child gets its own random source, so that the tree does not depend on which goroutine builds it
+	leftBuilder, rightBuilder := b.derive(), b.derive()
+	n.leftChild = NewNode(leftItems, leftBuilder)
+	n.rightChild = NewNode(rightItems, rightBuilder)
+
+	// build the left child in another goroutine if the subtree is large and a worker is available
+	if len(dataItems) >= parallelBuildThreshold && b.run.tryAcquire() {
+		var wg sync.WaitGroup
+		var leftErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer b.run.release()
+			leftErr = n.leftChild.build(leftItems, leftBuilder)
+		}()
+		rightErr := n.rightChild.build(rightItems, rightBuilder)
+		wg.Wait()
+		if leftErr != nil {
+			return leftErr
+		}
+		return rightErr
+	}
+
+	// build left child
+	if err := n.leftChild.build(leftItems, leftBuilder); err != nil {
+		return err
 	}
+	// build right child
+	return n.rightChild.build(rightItems, rightBuilder)
+}
+
+// direction ... returns the signed distance of a point from the split hyperplane, scaled by the norm of split
+func (n *node) direction(point []float64) float64 {
+	return calculateDirection(point, n.split) + n.offset
 }
 
 func calculateDirection(point, target []float64) float64 {
@@ -68,3 +118,53 @@ func calculateDirection(point, target []float64) float64 {
 	}
 	return direction
 }
+
+// insert routes an item down to its leaf and splits the leaf when it exceeds k items,
+// it returns the leaf so that the nodes created by the split can be registered
+func (n *node) insert(it *dataItem, items map[dataItemId]*dataItem, b *builder) *node {
+	if n.leftChild != nil && n.rightChild != nil {
+		// follow the same direction used when building the tree
+		if n.direction(it.vector) > 0 {
+			return n.rightChild.insert(it, items, b)
+		}
+		return n.leftChild.insert(it, items, b)
+	}
+
+	n.leafItems = append(n.leafItems, it.id)
+	if len(n.leafItems) > b.k && len(n.leafItems) >= n.splitAt {
+		dataItems := make([]*dataItem, len(n.leafItems))
+		for i, id := range n.leafItems {
+			dataItems[i] = items[id]
+		}
+		n.split, n.offset = getSplit(dataItems, b)
+		// the builders used by Add are not bound to a build run, so they cannot fail
+		_ = n.build(dataItems, b)
+		if n.leftChild == nil {
+			// the split left one side with at most k items, rather than trying again on every Add
+			// wait for the leaf to double, Compact rebuilds it in any case
+			n.split, n.offset = nil, 0
+			n.splitAt = 2 * len(n.leafItems)
+		}
+	}
+	return n
+}
+
+// remove drops the references to an item from the leaf it was routed to
+func (n *node) remove(it *dataItem) {
+	if n.leftChild != nil && n.rightChild != nil {
+		if n.direction(it.vector) > 0 {
+			n.rightChild.remove(it)
+		} else {
+			n.leftChild.remove(it)
+		}
+		return
+	}
+
+	leafItems := n.leafItems[:0]
+	for _, id := range n.leafItems {
+		if id != it.id {
+			leafItems = append(leafItems, id)
+		}
+	}
+	n.leafItems = leafItems
+}
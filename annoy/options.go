@@ -0,0 +1,59 @@
+package annoy
+
+import (
+	"errors"
+	"runtime"
+	"time"
+)
+
+// RandomSeed is the zero value of Options.Seed, which seeds every build from the current time,
+// so that two builds over the same items produce different trees
+const RandomSeed int64 = 0
+
+// Options are the optional settings used to build an index, the zero value builds an angular index
+type Options struct {
+	// Metric ... distance used to split the nodes and to rank the neighbours
+	Metric Metric
+	// Seed ... seeds the random sources used to build the trees, so that two builds over the same items
+	// produce the same index. The zero value is RandomSeed, a different seed for every build
+	Seed int64
+	// Split ... strategy used to find the hyperplane splitting the items of a node, defaults to FastTwoMeans
+	Split SplitStrategy
+	// Workers ... max number of goroutines building the trees, defaults to GOMAXPROCS
+	Workers int
+	// Progress ... if set, called while building the trees, one call at a time
+	Progress func(Progress)
+}
+
+// optionsOf ... returns the options passed to a constructor, or the defaults if none was passed
+func optionsOf(opts []Options) (Options, error) {
+	if len(opts) == 0 {
+		return Options{}, nil
+	}
+	if len(opts) > 1 {
+		return Options{}, errors.New("at most one Options can be provided")
+	}
+	if err := opts[0].Metric.validate(); err != nil {
+		return Options{}, err
+	}
+	if err := opts[0].Split.validate(); err != nil {
+		return Options{}, err
+	}
+	return opts[0], nil
+}
+
+// workers ... returns the number of goroutines used for a build
+func (o Options) workers() int {
+	if o.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.Workers
+}
+
+// seed ... returns the seed used for a build, drawn from the current time for RandomSeed
+func (o Options) seed() int64 {
+	if o.Seed == RandomSeed {
+		return time.Now().UnixNano()
+	}
+	return o.Seed
+}
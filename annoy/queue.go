@@ -1,35 +1,35 @@
 package annoy
 
-type queueItem struct {
+type queueItem[N any] struct {
 	index    int
-	value    nodeId
+	value    N
 	priority float64
 }
 
-type priorityQueue []*queueItem
+type priorityQueue[N any] []*queueItem[N]
 
-func (q priorityQueue) Len() int {
+func (q priorityQueue[N]) Len() int {
 	return len(q)
 }
 
-func (q priorityQueue) Swap(i, j int) {
+func (q priorityQueue[N]) Swap(i, j int) {
 	q[i], q[j] = q[j], q[i]
 	q[i].index = i
 	q[j].index = j
 }
 
-func (q priorityQueue) Less(i, j int) bool {
+func (q priorityQueue[N]) Less(i, j int) bool {
 	return q[i].priority < q[j].priority
 }
 
-func (q *priorityQueue) Push(x any) {
+func (q *priorityQueue[N]) Push(x any) {
 	l := len(*q)
-	queueItem := x.(*queueItem)
+	queueItem := x.(*queueItem[N])
 	queueItem.index = l
 	*q = append(*q, queueItem)
 }
 
-func (q *priorityQueue) Pop() any {
+func (q *priorityQueue[N]) Pop() any {
 	old := *q
 	n := len(old)
 	queueItem := old[n-1]
@@ -0,0 +1,257 @@
+package annoy
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// forest gives read access to the trees of an index regardless of where they are stored,
+// so that the in-memory and the memory-mapped indexes share the same search
+type forest[N any] interface {
+	// roots ... returns the root node of every tree
+	roots() []N
+	// visit ... returns the split hyperplane and children of an inner node, or the items of a leaf node
+	visit(n N) (split []float64, offset float64, left, right N, items []int64, leaf bool, err error)
+	// vector ... returns the vector of an item referenced by a leaf
+	vector(item int64) ([]float64, error)
+	// id ... returns the id exposed to callers for an item referenced by a leaf
+	id(item int64) int64
+}
+
+// Neighbor is an item found by a search, along with its distance from the query vector
+type Neighbor struct {
+	ID       int64
+	Distance float64
+}
+
+// neighbourIds ... drops the distances of the neighbours found by a search
+func neighbourIds(neighbours []Neighbor) []int64 {
+	ids := make([]int64, len(neighbours))
+	for i, n := range neighbours {
+		ids[i] = n.ID
+	}
+	return ids
+}
+
+// SearchOptions are the optional settings of a search
+type SearchOptions struct {
+	// SearchK ... number of nodes inspected in the trees, counting every item found in a leaf as in Annoy,
+	// defaults to k * numberOfTrees. Larger values increase the recall at the cost of latency, independently of k
+	SearchK int
+	// Workers ... max number of goroutines running the queries of FindSimilarBatch, defaults to GOMAXPROCS
+	Workers int
+	// Filter ... if set, only the items for which it returns true are returned. The search keeps inspecting
+	// the trees past SearchK until k items match, so it can be slow for very selective filters.
+	// It may be called concurrently and must not use the index
+	Filter func(id int64) bool
+}
+
+func (o SearchOptions) searchK(k int, numberOfTrees int) int {
+	if o.SearchK > 0 {
+		return o.SearchK
+	}
+	return k * numberOfTrees
+}
+
+func (o SearchOptions) workers() int {
+	if o.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.Workers
+}
+
+// searchBatch ... runs query for every vector over a pool of workers, returning the results in input order
+func searchBatch(vectors [][]float64, workers int, query func(v []float64) ([]Neighbor, error)) ([][]Neighbor, error) {
+	results := make([][]Neighbor, len(vectors))
+	errs := make([]error, len(vectors))
+	if workers > len(vectors) {
+		workers = len(vectors)
+	}
+
+	next := int64(-1)
+	var failed int32
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// stop picking up queries as soon as one of them failed
+			for atomic.LoadInt32(&failed) == 0 {
+				j := int(atomic.AddInt64(&next, 1))
+				if j >= len(vectors) {
+					return
+				}
+				if results[j], errs[j] = query(vectors[j]); errs[j] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("query %d: %w", j, err)
+		}
+	}
+	return results, nil
+}
+
+func findNeighbors[N any](f forest[N], metric Metric, v []float64, k int, bucketScale float64) (neighbours []Neighbor, err error) {
+	if k < 0 {
+		return nil, fmt.Errorf("invalid number of neighbours %d", k)
+	}
+	// 1. search for candidates in all trees
+	annMap, err := findCandidates(f, v, int(float64(k)*bucketScale), math.MaxInt, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. rank the candidates by their distance from v
+	if neighbours, err = rankCandidates(f, metric, v, annMap); err != nil {
+		return nil, err
+	}
+
+	// 3. return top k
+	if len(neighbours) > k {
+		neighbours = neighbours[:k]
+	}
+	return neighbours, nil
+}
+
+func search[N any](f forest[N], metric Metric, v []float64, k int, searchK int, filter func(id int64) bool) (neighbours []Neighbor, err error) {
+	if k < 0 {
+		return nil, fmt.Errorf("invalid number of neighbours %d", k)
+	}
+	// 1. search for candidates in all trees
+	annMap, err := findCandidates(f, v, math.MaxInt, searchK, filter, k)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. rank the candidates by their distance from v
+	if neighbours, err = rankCandidates(f, metric, v, annMap); err != nil {
+		return nil, err
+	}
+
+	// 3. return top k
+	if len(neighbours) > k {
+		neighbours = neighbours[:k]
+	}
+	return neighbours, nil
+}
+
+func findWithinDistance[N any](f forest[N], metric Metric, v []float64, maxDist float64, searchK int) (neighbours []Neighbor, err error) {
+	// 1. search for candidates in all trees
+	annMap, err := findCandidates(f, v, math.MaxInt, searchK, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. rank the candidates by their distance from v
+	if neighbours, err = rankCandidates(f, metric, v, annMap); err != nil {
+		return nil, err
+	}
+
+	// 3. return the candidates up to maxDist
+	cut := sort.Search(len(neighbours), func(j int) bool { return neighbours[j].Distance > maxDist })
+	return neighbours[:cut], nil
+}
+
+// findCandidates ... traverses the trees starting from the nodes closest to v, until either maxCandidates
+// distinct candidates are found or searchK nodes are inspected. If filter is set, only the items it accepts
+// are candidates, and the traversal goes on past searchK until minCandidates of them are found
+func findCandidates[N any](f forest[N], v []float64, maxCandidates int, searchK int, filter func(id int64) bool, minCandidates int) (map[int64]struct{}, error) {
+	// 1. init priority queue and insert the root nodes of all trees
+	pq := priorityQueue[N]{}
+	for i, r := range f.roots() {
+		n := &queueItem[N]{
+			value:    r,
+			index:    i,
+			priority: math.Inf(-1),
+		}
+		pq = append(pq, n)
+	}
+
+	annMap := map[int64]struct{}{}
+	inspected := 0
+
+	// 2. search for candidates in all trees
+	heap.Init(&pq)
+	for pq.Len() > 0 && len(annMap) < maxCandidates && (inspected < searchK || filter != nil && len(annMap) < minCandidates) {
+		q := heap.Pop(&pq).(*queueItem[N])
+		d := q.priority
+		split, offset, left, right, items, leaf, err := f.visit(q.value)
+		if err != nil {
+			return nil, err
+		}
+
+		if leaf {
+			for _, id := range items {
+				if filter == nil || filter(f.id(id)) {
+					annMap[id] = struct{}{}
+				}
+			}
+			inspected += len(items)
+			continue
+		}
+
+		dp := calculateDirection(split, v) + offset
+		heap.Push(&pq, &queueItem[N]{
+			value:    left,
+			priority: math.Max(d, dp),
+		})
+		heap.Push(&pq, &queueItem[N]{
+			value:    right,
+			priority: math.Max(d, -dp),
+		})
+	}
+	return annMap, nil
+}
+
+// rankCandidates ... returns the candidates sorted by ascending distance from v
+func rankCandidates[N any](f forest[N], metric Metric, v []float64, annMap map[int64]struct{}) ([]Neighbor, error) {
+	// 1. calculate cross-similarity between query vector v and all candidates
+	idToDist := make(map[int64]float64, len(annMap))
+	for item := range annMap {
+		vector, err := f.vector(item)
+		if err != nil {
+			return nil, err
+		}
+		if idToDist[f.id(item)], err = metric.distance(vector, v); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. sort candidates by distance asc
+	candidates := sortCandidates(idToDist)
+	neighbours := make([]Neighbor, len(candidates))
+	for j, id := range candidates {
+		neighbours[j] = Neighbor{ID: id, Distance: idToDist[id]}
+	}
+	return neighbours, nil
+}
+
+func sortCandidates(idToDistance map[int64]float64) []int64 {
+	candidates := make([]int64, 0, len(idToDistance))
+
+	for id := range idToDistance {
+		candidates = append(candidates, id)
+	}
+
+	// sort candidates by descending similarity / ascending distance, breaking ties by id for reproducible results
+	sort.Slice(candidates, func(i, j int) bool {
+		di, dj := idToDistance[candidates[i]], idToDistance[candidates[j]]
+		if di != dj {
+			return di < dj
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	return candidates
+}
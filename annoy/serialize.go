@@ -0,0 +1,341 @@
+package annoy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// the on-disk layout of an index is:
+//
+//	header ... fixed size, see fileHeader
+//	roots  ... numTrees x uint32, position of each tree root in the nodes block
+//	ids    ... numItems x int64, item ids
+//	data   ... numItems x dim x float64, item vectors in the same order as ids
+//	nodes  ... numNodes x (left, right, leafStart, leafCount uint32 + offset float64 + dim x float64 split)
+//	leaves ... numLeafRefs x uint32, positions of the items referenced by the leaf nodes
+//
+// all values are little endian, inner nodes have leafCount 0 and leaves have left and right set to noChild
+const (
+	formatVersion uint32 = 1
+	noChild       uint32 = math.MaxUint32
+)
+
+var formatMagic = [4]byte{'A', 'P', 'A', 'N'}
+
+var byteOrder = binary.LittleEndian
+
+type fileHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	Dim         uint32
+	LeafSize    uint32
+	NumTrees    uint32
+	Metric      uint32
+	NumItems    uint64
+	NumNodes    uint64
+	NumLeafRefs uint64
+}
+
+type nodeRecord struct {
+	Left      uint32
+	Right     uint32
+	LeafStart uint32
+	LeafCount uint32
+}
+
+// Save writes the index to w in a versioned binary format that can be read back with Load
+func (i *index) Save(w io.Writer) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	// 1. assign a stable position to every item that was not removed, ordered by id
+	ids := make([]int64, 0, len(i.items))
+	for id := range i.items {
+		if _, ok := i.lookup(id); ok {
+			ids = append(ids, int64(id))
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	positions := make(map[dataItemId]uint32, len(ids))
+	for p, id := range ids {
+		positions[dataItemId(id)] = uint32(p)
+	}
+
+	// 2. flatten all trees into a single node array (pre-order)
+	nodes := []*node{}
+	nodePositions := map[*node]uint32{}
+	var flatten func(n *node)
+	flatten = func(n *node) {
+		nodePositions[n] = uint32(len(nodes))
+		nodes = append(nodes, n)
+		if n.leftChild != nil && n.rightChild != nil {
+			flatten(n.leftChild)
+			flatten(n.rightChild)
+		}
+	}
+	roots := make([]uint32, len(i.trees))
+	for t, r := range i.trees {
+		flatten(r)
+		roots[t] = nodePositions[r]
+	}
+
+	records := make([]nodeRecord, len(nodes))
+	leaves := []uint32{}
+	for p, n := range nodes {
+		if n.leftChild != nil && n.rightChild != nil {
+			records[p] = nodeRecord{Left: nodePositions[n.leftChild], Right: nodePositions[n.rightChild]}
+			continue
+		}
+		leafStart := uint32(len(leaves))
+		for _, id := range n.leafItems {
+			if _, removed := i.deleted[id]; removed {
+				continue
+			}
+			pos, ok := positions[id]
+			if !ok {
+				return fmt.Errorf("leaf references unknown item %d", id)
+			}
+			leaves = append(leaves, pos)
+		}
+		records[p] = nodeRecord{Left: noChild, Right: noChild, LeafStart: leafStart, LeafCount: uint32(len(leaves)) - leafStart}
+	}
+
+	// 3. write all sections
+	bw := bufio.NewWriter(w)
+	header := fileHeader{
+		Magic:       formatMagic,
+		Version:     formatVersion,
+		Dim:         uint32(i.size),
+		LeafSize:    uint32(i.k),
+		NumTrees:    uint32(len(i.trees)),
+		Metric:      uint32(i.metric),
+		NumItems:    uint64(len(ids)),
+		NumNodes:    uint64(len(nodes)),
+		NumLeafRefs: uint64(len(leaves)),
+	}
+	if err := binary.Write(bw, byteOrder, header); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, byteOrder, roots); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, byteOrder, ids); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		v := i.items[dataItemId(id)].vector
+		if len(v) != i.size {
+			return fmt.Errorf("item %d has dimension %d, expected %d", id, len(v), i.size)
+		}
+		if err := binary.Write(bw, byteOrder, v); err != nil {
+			return err
+		}
+	}
+	zeroSplit := make([]float64, i.size)
+	for p, n := range nodes {
+		if err := binary.Write(bw, byteOrder, records[p]); err != nil {
+			return err
+		}
+		split, offset := n.split, n.offset
+		if records[p].Left == noChild || len(split) != i.size {
+			// leaves do not need a split, pad the record
+			split, offset = zeroSplit, 0
+		}
+		if err := binary.Write(bw, byteOrder, offset); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, byteOrder, split); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(bw, byteOrder, leaves); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Load reads an index previously written with Save, validating its format version, dimension and trees
+func Load(r io.Reader) (Index, error) {
+	br := bufio.NewReader(r)
+
+	// 1. read and validate the header
+	var header fileHeader
+	if err := binary.Read(br, byteOrder, &header); err != nil {
+		return nil, fmt.Errorf("reading index header: %w", err)
+	}
+	if err := header.validate(); err != nil {
+		return nil, err
+	}
+	dim := int(header.Dim)
+
+	// 2. read the flat sections, the counts come from the header so the slices only grow as the data is read
+	roots, err := readSlice[uint32](br, uint64(header.NumTrees))
+	if err != nil {
+		return nil, fmt.Errorf("reading tree roots: %w", err)
+	}
+	ids, err := readSlice[int64](br, header.NumItems)
+	if err != nil {
+		return nil, fmt.Errorf("reading item ids: %w", err)
+	}
+	items := make(map[dataItemId]*dataItem, len(ids))
+	for _, id := range ids {
+		v, err := readSlice[float64](br, uint64(dim))
+		if err != nil {
+			return nil, fmt.Errorf("reading vector of item %d: %w", id, err)
+		}
+		if _, exists := items[dataItemId(id)]; exists {
+			return nil, fmt.Errorf("duplicate item id %d", id)
+		}
+		items[dataItemId(id)] = &dataItem{id: dataItemId(id), vector: v}
+	}
+	records := []nodeRecord{}
+	offsets := []float64{}
+	splits := [][]float64{}
+	for p := uint64(0); p < header.NumNodes; p++ {
+		var rec nodeRecord
+		if err := binary.Read(br, byteOrder, &rec); err != nil {
+			return nil, fmt.Errorf("reading node %d: %w", p, unexpectedEOF(err))
+		}
+		var offset float64
+		if err := binary.Read(br, byteOrder, &offset); err != nil {
+			return nil, fmt.Errorf("reading offset of node %d: %w", p, unexpectedEOF(err))
+		}
+		split, err := readSlice[float64](br, uint64(dim))
+		if err != nil {
+			return nil, fmt.Errorf("reading split of node %d: %w", p, err)
+		}
+		records = append(records, rec)
+		offsets = append(offsets, offset)
+		splits = append(splits, split)
+	}
+	leaves, err := readSlice[uint32](br, header.NumLeafRefs)
+	if err != nil {
+		return nil, fmt.Errorf("reading leaves: %w", err)
+	}
+
+	// 3. rebuild and validate the trees
+	idx := &index{
+		k:      int(header.LeafSize),
+		size:   dim,
+		metric: Metric(header.Metric),
+		// the trees were built already, the random source is only used to split the leaves grown by Add
+		builder: newBuilder(int(header.LeafSize), Options{Metric: Metric(header.Metric)}),
+		trees:   make([]*node, len(roots)),
+		nodes:   make(map[nodeId]*node, len(records)),
+		items:   items,
+
+		deleted: map[dataItemId]struct{}{},
+	}
+	nodes := make([]*node, len(records))
+	var rebuild func(p uint32) (*node, error)
+	rebuild = func(p uint32) (*node, error) {
+		if uint64(p) >= header.NumNodes {
+			return nil, fmt.Errorf("node %d out of range", p)
+		}
+		if nodes[p] != nil {
+			return nil, fmt.Errorf("node %d is referenced more than once", p)
+		}
+		rec := records[p]
+		n := &node{id: nodeId(uuid.New().String()), leafItems: []dataItemId{}}
+		nodes[p] = n
+		idx.nodes[n.id] = n
+		if rec.Left == noChild || rec.Right == noChild {
+			if rec.Left != rec.Right {
+				return nil, fmt.Errorf("node %d has a single child", p)
+			}
+			if uint64(rec.LeafStart)+uint64(rec.LeafCount) > header.NumLeafRefs {
+				return nil, fmt.Errorf("leaf %d out of range", p)
+			}
+			n.leafItems = make([]dataItemId, rec.LeafCount)
+			for j, pos := range leaves[rec.LeafStart : rec.LeafStart+rec.LeafCount] {
+				if uint64(pos) >= header.NumItems {
+					return nil, fmt.Errorf("leaf %d references unknown item position %d", p, pos)
+				}
+				n.leafItems[j] = dataItemId(ids[pos])
+			}
+			return n, nil
+		}
+		n.split, n.offset = splits[p], offsets[p]
+		var err error
+		if n.leftChild, err = rebuild(rec.Left); err != nil {
+			return nil, err
+		}
+		if n.rightChild, err = rebuild(rec.Right); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	for t, p := range roots {
+		root, err := rebuild(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree %d: %w", t, err)
+		}
+		idx.trees[t] = root
+	}
+	for p, n := range nodes {
+		if n == nil {
+			return nil, fmt.Errorf("node %d is not reachable from any tree", p)
+		}
+	}
+	return idx, nil
+}
+
+// readChunkSize ... max number of values allocated at once by readSlice
+const readChunkSize = 1 << 16
+
+// readSlice ... reads n values from r in chunks, so that a corrupt count fails with an error once the input
+// is exhausted instead of allocating all the values up front
+func readSlice[T any](r io.Reader, n uint64) ([]T, error) {
+	size := n
+	if size > readChunkSize {
+		size = readChunkSize
+	}
+	values := make([]T, 0, size)
+	for uint64(len(values)) < n {
+		chunk := n - uint64(len(values))
+		if chunk > readChunkSize {
+			chunk = readChunkSize
+		}
+		buf := make([]T, chunk)
+		if err := binary.Read(r, byteOrder, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		values = append(values, buf...)
+	}
+	return values, nil
+}
+
+// unexpectedEOF ... reports the end of the input as unexpected, since it is only reached before all the
+// values announced by the header are read
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (h fileHeader) validate() error {
+	if h.Magic != formatMagic {
+		return errors.New("not an annoy index file")
+	}
+	if h.Version != formatVersion {
+		return fmt.Errorf("unsupported index format version %d, expected %d", h.Version, formatVersion)
+	}
+	if h.Dim == 0 {
+		return errors.New("invalid index dimension 0")
+	}
+	if err := Metric(h.Metric).validate(); err != nil {
+		return err
+	}
+	if h.NumItems > math.MaxUint32 || h.NumNodes > math.MaxUint32 || h.NumLeafRefs > math.MaxUint32 {
+		return errors.New("index too large")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package annoy
+
+import (
+	"fmt"
+
+	"github.com/pilillo/apostasi/common"
+)
+
+// SplitStrategy is the way the hyperplane splitting the items of a node is found while building the trees
+type SplitStrategy uint32
+
+const (
+	// FastTwoMeans ... runs a few iterations of 2-means over a sample of the items of the node, as in Annoy
+	FastTwoMeans SplitStrategy = iota
+	// ExactKMeans ... runs 2-means until convergence over all the items of the node, which is much slower
+	ExactKMeans
+)
+
+const (
+	// twoMeansSampleSize ... max number of items of a node sampled by FastTwoMeans
+	twoMeansSampleSize = 256
+	// twoMeansIterations ... number of iterations run by FastTwoMeans
+	twoMeansIterations = 5
+	// kMeansIterations ... max number of iterations run by ExactKMeans
+	kMeansIterations = 200
+)
+
+func (s SplitStrategy) String() string {
+	switch s {
+	case FastTwoMeans:
+		return "fast-two-means"
+	case ExactKMeans:
+		return "exact-kmeans"
+	default:
+		return fmt.Sprintf("SplitStrategy(%d)", uint32(s))
+	}
+}
+
+func (s SplitStrategy) validate() error {
+	if s > ExactKMeans {
+		return fmt.Errorf("unknown split strategy %d", uint32(s))
+	}
+	return nil
+}
+
+// getSplit returns the hyperplane separating the two clusters of dataItems, as its normal and an offset
+// such that items are on the right side when dot(normal, item) + offset > 0. The hyperplane goes through
+// the midpoint of the two centroids, but for the metrics comparing items by direction only, where it goes
+// through the origin.
+func getSplit(dataItems []*dataItem, b *builder) ([]float64, float64) {
+	if len(dataItems) < 2 {
+		// nothing to split, the node can only be a leaf
+		return nil, 0
+	}
+
+	maxIterations := kMeansIterations
+	if b.split == FastTwoMeans {
+		dataItems = sample(dataItems, twoMeansSampleSize, b)
+		maxIterations = twoMeansIterations
+	}
+
+	data := rawDataFromDataItems(dataItems)
+	if b.metric.normalized() {
+		// compare the items by direction only
+		for i, v := range data {
+			data[i] = normalize(v)
+		}
+	}
+
+	centroids, _ := common.KMeans(b.rng.Int63(), data, 2, maxIterations, b.metric.similarity())
+
+	split := make([]float64, len(centroids[0]))
+	offset := 0.0
+	for d := 0; d < len(centroids[0]); d++ {
+		v := centroids[0][d] - centroids[1][d]
+		split[d] += v
+		if !b.metric.normalized() {
+			offset -= v * (centroids[0][d] + centroids[1][d]) / 2
+		}
+	}
+	return split, offset
+}
+
+// sample ... returns size distinct items drawn at random, using Floyd's algorithm
+func sample(dataItems []*dataItem, size int, b *builder) []*dataItem {
+	n := len(dataItems)
+	if n <= size {
+		return dataItems
+	}
+	chosen := make(map[int]struct{}, size)
+	sampled := make([]*dataItem, 0, size)
+	for j := n - size; j < n; j++ {
+		t := b.rng.Intn(j + 1)
+		if _, ok := chosen[t]; ok {
+			t = j
+		}
+		chosen[t] = struct{}{}
+		sampled = append(sampled, dataItems[t])
+	}
+	return sampled
+}
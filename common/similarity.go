@@ -76,6 +76,33 @@ func EuclideanDistance[T featurizable](v1, v2 []T) (distance float64, err error)
 	return
 }
 
+func ManhattanDistance[T featurizable](v1, v2 []T) (distance float64, err error) {
+	if len(v1) != len(v2) {
+		err = errors.New("unequal length vectors provided")
+		return
+	}
+	distance = 0
+	for i := 0; i < len(v1); i++ {
+		distance += math.Abs(float64(v1[i] - v2[i]))
+	}
+	return
+}
+
+// HammingDistance function returns the number of positions at which two equal-length vectors differ
+func HammingDistance[T featurizable](v1, v2 []T) (distance float64, err error) {
+	if len(v1) != len(v2) {
+		err = errors.New("unequal length vectors provided")
+		return
+	}
+	distance = 0
+	for i := 0; i < len(v1); i++ {
+		if v1[i] != v2[i] {
+			distance++
+		}
+	}
+	return
+}
+
 func CosineDistance[T featurizable](v1, v2 []T) (distance float64, err error) {
 	cos, err := Cosine(v1, v2)
 	if err == nil {
@@ -88,7 +115,7 @@ func ArgMax[T featurizable](data []T) int {
 	var maxVal T
 	var maxIdx int
 	for i, v := range data {
-		if v >= maxVal {
+		if i == 0 || v >= maxVal {
 			maxVal = v
 			maxIdx = i
 		}
@@ -139,9 +166,9 @@ func KMeans[T featurizable](seed int64, data [][]T, k int, maxIterations int, si
 		return data, fmt.Errorf("the size of the data set must at least equal k")
 	}
 
-	// Randomly select initial centroids on the dataset
-	rand.Seed(seed)
-	permutation := rand.Perm(len(data))
+	// Randomly select initial centroids on the dataset, using a local source so that concurrent calls do not interfere
+	rng := rand.New(rand.NewSource(seed))
+	permutation := rng.Perm(len(data))
 
 	previousCentroidsData := make([][]T, k)
 	centroidsData := make([][]T, k)
@@ -165,8 +192,8 @@ func KMeans[T featurizable](seed int64, data [][]T, k int, maxIterations int, si
 			clusters[closestCentroidIndex] = append(clusters[closestCentroidIndex], vector)
 		}
 
-		// set current centroids to previous
-		previousCentroidsData = centroidsData
+		// set current centroids to previous, copying them since the current ones are updated in place
+		previousCentroidsData = append([][]T{}, centroidsData...)
 
 		// set new centroids to mean of points belonging to them
 		for centroidIndex, points := range clusters {
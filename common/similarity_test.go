@@ -31,6 +31,18 @@ func TestKMeans(t *testing.T) {
 	}, centroids, "wrong clusters found")
 }
 
+func TestKMeansConverges(t *testing.T) {
+	points := [][]float64{{0}, {1}, {2}, {3}, {10}, {11}, {12}, {13}}
+	// with this seed both initial centroids fall in the upper group, so one iteration is not enough
+	seed := int64(16)
+	firstIteration, err := KMeans(seed, points, 2, 1, EuclideanSimilarity[float64])
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float64{{13}, {5.571428571428571}}, firstIteration)
+	centroids, err := KMeans(seed, points, 2, 200, EuclideanSimilarity[float64])
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float64{{11.5}, {1.5}}, centroids, "clustering stopped before converging")
+}
+
 func TestMean(t *testing.T) {
 	points := [][]float64{
 		{1, 1, 1},
@@ -46,4 +58,21 @@ func TestMean(t *testing.T) {
 
 func TestArgMax(t *testing.T) {
 	assert.Equal(t, 1, ArgMax([]int{1, 50, 2, 20}), "wrong argmax index")
+	assert.Equal(t, 2, ArgMax([]float64{-3.5, -10, -0.5, -7}), "wrong argmax index for negative values")
+}
+
+func TestManhattanDistance(t *testing.T) {
+	d, err := ManhattanDistance([]float64{1, 2, 3}, []float64{4, 0, 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, d)
+	_, err = ManhattanDistance([]float64{1, 2, 3}, []float64{4, 0})
+	assert.ErrorContains(t, err, "unequal length vectors provided")
+}
+
+func TestHammingDistance(t *testing.T) {
+	d, err := HammingDistance([]int{1, 0, 1, 1}, []int{1, 1, 0, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, d)
+	_, err = HammingDistance([]int{1, 0}, []int{1})
+	assert.ErrorContains(t, err, "unequal length vectors provided")
 }
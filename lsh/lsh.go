@@ -1,28 +1,99 @@
+// Package lsh implements approximate nearest neighbours search with random hyperplane locality sensitive hashing.
+//
+// The hyperplanes are random: unless Options.Seed is set to a non-zero value, New seeds them from the
+// current time (see RandomSeed), so two indexes over the same items hash them differently. Set a seed to
+// make the indexes reproducible; Save stores the seed and Load restores it.
 package lsh
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
-	"strconv"
+	"sync"
 
 	"github.com/pilillo/apostasi/common"
 	"gonum.org/v1/gonum/stat/combin"
 )
 
-type lshUtil struct {
-	seed          int64
-	numBits       int
+var errNotInitialized = errors.New("the hyperplanes are not initialized")
+
+// hashTable ... buckets the items by the signs of their projections on its own set of random hyperplanes
+type hashTable struct {
 	randomVectors [][]float64
-	table         map[int64][]any
+	buckets       map[signature][]any
 }
 
-func NewLshUtil(seed int64, numBits int) *lshUtil {
-	rand.Seed(seed)
-	return &lshUtil{seed: seed, numBits: numBits, table: map[int64][]any{}}
+// Index is a random hyperplane LSH index, hashing the items in one or more tables with a bucket per signature.
+// It is safe for concurrent use: queries run in parallel with each other, while insertions, deletions
+// and updates are serialized and wait for the running queries.
+// The zero value has no tables, and its methods return an error: build an Index with New or Load
+type Index struct {
+	// mu ... guards the tables, the hyperplanes and the vectors: queries hold it for reading, mutations for writing.
+	// A single lock keeps an item in either all the tables or none, which Delete and Update rely on: every
+	// mutation touches one bucket per table plus itemBuckets, so sharding the buckets would still need a lock
+	// over the items, while the write lock is only held for a few map updates per table
+	mu sync.RWMutex
+
+	seed    int64
+	numBits int
+	tables  []*hashTable
+	// dim ... number of components of the vectors, set when the hyperplanes are initialized
+	dim int
+	// rng ... random source of the hyperplanes, owned by the index
+	rng *rand.Rand
+	// generation ... incremented every time the hyperplanes are drawn, so that the mutations encoding their
+	// vectors before taking the write lock can tell whether the hyperplanes changed in the meantime
+	generation uint64
+
+	// itemBuckets ... bucket of every inserted item in each table, used to delete them
+	itemBuckets map[any][]signature
+	// vectors ... vectors of the inserted items, only kept after StoreVectors is called
+	vectors map[any][]float64
+	// lookup ... returns the vectors of the items that are not stored, as set by SetVectorLookup
+	lookup func(id any) ([]float64, bool)
 }
 
-func (lsh *lshUtil) generateRandFloatVectors(min float64, max float64, numFeatures int, numSplits int) [][]float64 {
+// New returns an index over vectors of dim components, with its hyperplanes already drawn as set by opts
+func New(dim int, opts ...Options) (*Index, error) {
+	options, err := optionsOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	if dim <= 0 {
+		return nil, fmt.Errorf("invalid dimension %d", dim)
+	}
+	lsh := newIndex(options.seed(), options.tables(), options.bits())
+	lsh.initHyperplanes(dim, options.Orthogonal)
+	if options.StoreVectors {
+		lsh.vectors = map[any][]float64{}
+	}
+	return lsh, nil
+}
+
+// NewLshUtil ... returns an LSH index with a single table of numBits bits.
+//
+// Deprecated: use New, NewLshUtil requires the hyperplanes to be initialized before the index is used
+func NewLshUtil(seed int64, numBits int) *Index {
+	return newIndex(seed, 1, numBits)
+}
+
+func newIndex(seed int64, numTables int, numBits int) *Index {
+	tables := make([]*hashTable, numTables)
+	for t := range tables {
+		tables[t] = &hashTable{buckets: map[signature][]any{}}
+	}
+	return &Index{
+		seed:        seed,
+		numBits:     numBits,
+		tables:      tables,
+		rng:         rand.New(rand.NewSource(seed)),
+		itemBuckets: map[any][]signature{},
+	}
+}
+
+func (lsh *Index) generateRandFloatVectors(min float64, max float64, numFeatures int, numSplits int) [][]float64 {
 
 	res := make([][]float64, numSplits)
 	for i := range res {
@@ -31,104 +102,338 @@ func (lsh *lshUtil) generateRandFloatVectors(min float64, max float64, numFeatur
 	return res
 }
 
-func (lsh *lshUtil) generateRandFloatVector(min float64, max float64, numFeatures int) []float64 {
+func (lsh *Index) generateRandFloatVector(min float64, max float64, numFeatures int) []float64 {
+	res := make([]float64, numFeatures)
+	for i := range res {
+		res[i] = min + lsh.rng.Float64()*(max-min)
+	}
+	return res
+}
+
+// Init ... draws numSplits random hyperplanes for every table, with components uniformly distributed in [min, max].
+// Unless the range is centered in zero, the hyperplanes are not uniformly oriented and most vectors end up
+// in the same bucket.
+//
+// Deprecated: use New, which draws the hyperplanes as InitHyperplanes does
+func (lsh *Index) Init(min float64, max float64, numFeatures int, numSplits int) {
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	lsh.dim = numFeatures
+	lsh.generation++
+	for _, t := range lsh.tables {
+		t.randomVectors = lsh.generateRandFloatVectors(min, max, numFeatures, numSplits)
+	}
+}
+
+// InitHyperplanes ... draws numBits random hyperplanes for every table, with standard normal components so that
+// their orientation is uniformly distributed (SimHash). If orthogonal is set, the hyperplanes are orthogonalised
+// in groups of numFeatures, which is the max number of mutually orthogonal vectors.
+// The items already inserted are not moved, so it should only be called before inserting any item
+func (lsh *Index) InitHyperplanes(numFeatures int, orthogonal bool) {
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	lsh.initHyperplanes(numFeatures, orthogonal)
+}
+
+func (lsh *Index) initHyperplanes(numFeatures int, orthogonal bool) {
+	lsh.dim = numFeatures
+	lsh.generation++
+	for _, t := range lsh.tables {
+		t.randomVectors = make([][]float64, lsh.numBits)
+		for i := range t.randomVectors {
+			t.randomVectors[i] = lsh.generateNormFloatVector(numFeatures)
+		}
+		if orthogonal {
+			for start := 0; start < len(t.randomVectors); start += numFeatures {
+				end := start + numFeatures
+				if end > len(t.randomVectors) {
+					end = len(t.randomVectors)
+				}
+				lsh.orthogonalize(t.randomVectors[start:end])
+			}
+		}
+	}
+}
+
+func (lsh *Index) generateNormFloatVector(numFeatures int) []float64 {
 	res := make([]float64, numFeatures)
 	for i := range res {
-		res[i] = min + rand.Float64()*(max-min)
+		res[i] = lsh.rng.NormFloat64()
 	}
 	return res
 }
 
-func (lsh *lshUtil) Init(min float64, max float64, numFeatures int, numSplits int) {
-	lsh.randomVectors = lsh.generateRandFloatVectors(min, max, numFeatures, numSplits)
+// orthogonalize ... turns vectors into an orthonormal set using the Gram-Schmidt process
+func (lsh *Index) orthogonalize(vectors [][]float64) {
+	for i, v := range vectors {
+		for _, u := range vectors[:i] {
+			projection := lsh.dot(v, u)
+			for j := range v {
+				v[j] -= projection * u[j]
+			}
+		}
+		norm := math.Sqrt(lsh.dot(v, v))
+		for j := range v {
+			v[j] /= norm
+		}
+	}
 }
 
-func (lsh *lshUtil) dot(v1 []float64, v2 []float64) (dot float64) {
+func (lsh *Index) dot(v1 []float64, v2 []float64) (dot float64) {
 	for i := 0; i < len(v1); i++ {
 		dot += v1[i] * v2[i]
 	}
 	return
 }
 
-func (lsh *lshUtil) encodeVector(point []float64) (int64, error) {
-	sig := ""
-	for i := 0; i < len(point); i++ {
-		if lsh.dot(point, lsh.randomVectors[i]) >= 0.0 {
-			sig += "1"
-		} else {
-			sig += "0"
+// encodeVector ... returns the bucket of point in the given table, made of one bit per hyperplane
+func (lsh *Index) encodeVector(table int, point []float64) (signature, error) {
+	var sig signature
+	if len(lsh.tables[table].randomVectors) == 0 {
+		return sig, errNotInitialized
+	}
+	if len(point) != lsh.dim {
+		return sig, fmt.Errorf("vector has dimension %d, expected %d", len(point), lsh.dim)
+	}
+	if lsh.numBits > maxBits {
+		return sig, fmt.Errorf("signatures of %d bits are not supported, the max is %d", lsh.numBits, maxBits)
+	}
+	if len(lsh.tables[table].randomVectors) < lsh.numBits {
+		return sig, fmt.Errorf("%d random vectors initialized, %d are needed", len(lsh.tables[table].randomVectors), lsh.numBits)
+	}
+	for i := 0; i < lsh.numBits; i++ {
+		if lsh.dot(point, lsh.tables[table].randomVectors[i]) >= 0.0 {
+			sig.set(i)
 		}
 	}
+	return sig, nil
+}
 
-	return strconv.ParseInt(sig, 2, 64)
+// InsertOne ... adds index to its bucket in every table, the index must not have been inserted already
+func (lsh *Index) InsertOne(index any, v []float64) error {
+	bucketIndexes, generation, err := lsh.encode(v)
+	if err != nil {
+		return err
+	}
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	if bucketIndexes, err = lsh.reencode(v, bucketIndexes, generation); err != nil {
+		return err
+	}
+	return lsh.insertOne(index, v, bucketIndexes)
 }
 
-func (lsh *lshUtil) InsertOne(index any, v []float64) error {
-	bucketIndex, err := lsh.encodeVector(v)
+func (lsh *Index) insertOne(index any, v []float64, bucketIndexes []signature) error {
+	if _, exists := lsh.itemBuckets[index]; exists {
+		return fmt.Errorf("item %v already exists", index)
+	}
+	lsh.add(index, v, bucketIndexes)
+	return nil
+}
+
+// Delete ... removes index from all tables
+func (lsh *Index) Delete(index any) error {
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	if _, exists := lsh.itemBuckets[index]; !exists {
+		return fmt.Errorf("no item found for id: %v", index)
+	}
+	lsh.remove(index)
+	return nil
+}
+
+// Update ... moves index to the buckets of its new vector v
+func (lsh *Index) Update(index any, v []float64) error {
+	bucketIndexes, generation, err := lsh.encode(v)
 	if err != nil {
 		return err
 	}
-	bucketContent, exists := lsh.table[bucketIndex]
-	if !exists {
-		bucketContent = []any{}
-		lsh.table[bucketIndex] = bucketContent
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	if _, exists := lsh.itemBuckets[index]; !exists {
+		return fmt.Errorf("no item found for id: %v", index)
 	}
-	lsh.table[bucketIndex] = append(bucketContent, index)
+	if bucketIndexes, err = lsh.reencode(v, bucketIndexes, generation); err != nil {
+		return err
+	}
+	lsh.remove(index)
+	lsh.add(index, v, bucketIndexes)
 	return nil
 }
 
-func (lsh *lshUtil) Insert(data map[any][]float64) error {
+// encode ... same as encodeTables, holding the read lock so that the vectors are encoded in parallel
+// with the queries and the other encodings, and the write lock is only taken to update the tables.
+// It also returns the generation of the hyperplanes used, to be checked with reencode
+func (lsh *Index) encode(v []float64) ([]signature, uint64, error) {
+	lsh.mu.RLock()
+	defer lsh.mu.RUnlock()
+	bucketIndexes, err := lsh.encodeTables(v)
+	return bucketIndexes, lsh.generation, err
+}
+
+// reencode ... returns bucketIndexes if the hyperplanes are still at the generation they were encoded with,
+// otherwise it encodes v again with the current hyperplanes. The write lock must be held
+func (lsh *Index) reencode(v []float64, bucketIndexes []signature, generation uint64) ([]signature, error) {
+	if generation == lsh.generation {
+		return bucketIndexes, nil
+	}
+	return lsh.encodeTables(v)
+}
+
+// encodeTables ... returns the bucket of v in every table, encoding all of them before any table is changed
+// so that a failure does not leave an item in some tables only
+func (lsh *Index) encodeTables(v []float64) ([]signature, error) {
+	if len(lsh.tables) == 0 {
+		return nil, errNotInitialized
+	}
+	bucketIndexes := make([]signature, len(lsh.tables))
+	for t := range lsh.tables {
+		bucketIndex, err := lsh.encodeVector(t, v)
+		if err != nil {
+			return nil, err
+		}
+		bucketIndexes[t] = bucketIndex
+	}
+	return bucketIndexes, nil
+}
+
+func (lsh *Index) add(index any, v []float64, bucketIndexes []signature) {
+	for t, table := range lsh.tables {
+		table.buckets[bucketIndexes[t]] = append(table.buckets[bucketIndexes[t]], index)
+	}
+	lsh.itemBuckets[index] = bucketIndexes
+	if lsh.vectors != nil {
+		lsh.vectors[index] = v
+	}
+}
+
+func (lsh *Index) remove(index any) {
+	for t, bucketIndex := range lsh.itemBuckets[index] {
+		table := lsh.tables[t]
+		bucket := table.buckets[bucketIndex]
+		for i, document := range bucket {
+			if document == index {
+				// keep the insertion order of the remaining documents
+				bucket = append(bucket[:i], bucket[i+1:]...)
+				break
+			}
+		}
+		// drop empty buckets, so that they are skipped when probing
+		if len(bucket) == 0 {
+			delete(table.buckets, bucketIndex)
+		} else {
+			table.buckets[bucketIndex] = bucket
+		}
+	}
+	delete(lsh.itemBuckets, index)
+	delete(lsh.vectors, index)
+}
+
+// Insert ... same as InsertOne for every item of data, none is inserted if any of the vectors is invalid
+// or any of the items already exists
+func (lsh *Index) Insert(data map[any][]float64) error {
+	bucketIndexes := make(map[any][]signature, len(data))
+	generations := make(map[any]uint64, len(data))
+	for k, v := range data {
+		b, generation, err := lsh.encode(v)
+		if err != nil {
+			return err
+		}
+		bucketIndexes[k], generations[k] = b, generation
+	}
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
 	for k, v := range data {
-		if err := lsh.InsertOne(k, v); err != nil {
+		if _, exists := lsh.itemBuckets[k]; exists {
+			return fmt.Errorf("item %v already exists", k)
+		}
+		b, err := lsh.reencode(v, bucketIndexes[k], generations[k])
+		if err != nil {
 			return err
 		}
+		bucketIndexes[k] = b
+	}
+	for k, v := range data {
+		lsh.add(k, v, bucketIndexes[k])
 	}
 	return nil
 }
 
-func (lsh *lshUtil) flip(queryBucket int64, flipBits []int) int64 {
+func (lsh *Index) flip(queryBucket signature, flipBits []int) signature {
 	for _, b := range flipBits {
-		queryBucket ^= 1 << b
+		queryBucket = queryBucket.flip(b)
 	}
 	return queryBucket
 }
 
-func (lsh *lshUtil) getBucketsInRadius(queryBucket int64, radius int) []int64 {
-	//var err error
-	res := []int64{}
+// getBucketsInRadius ... returns the non-empty buckets of a table within radius bits from queryBucket
+func (lsh *Index) getBucketsInRadius(table int, queryBucket signature, radius int) []signature {
+	res := []signature{}
 	for r := 0; r <= radius; r++ {
-		combs := combin.Combinations(lsh.numBits, r)
-		for _, c := range combs {
-			candidateBucket := lsh.flip(queryBucket, c)
-			if _, ok := lsh.table[candidateBucket]; ok {
-				res = append(res, candidateBucket)
-			}
+		res = append(res, lsh.getBucketsAtDistance(table, queryBucket, r)...)
+	}
+	return res
+}
+
+// getBucketsAtDistance ... returns the non-empty buckets of a table differing from queryBucket by exactly r bits
+func (lsh *Index) getBucketsAtDistance(table int, queryBucket signature, r int) []signature {
+	res := []signature{}
+	if r > lsh.numBits {
+		return res
+	}
+	for _, c := range combin.Combinations(lsh.numBits, r) {
+		candidateBucket := lsh.flip(queryBucket, c)
+		if _, ok := lsh.tables[table].buckets[candidateBucket]; ok {
+			res = append(res, candidateBucket)
 		}
 	}
 	return res
 }
 
-func (lsh *lshUtil) Query(point []float64, searchRadius int) ([]any, error) {
-	// retrieve query bucket
-	queryBucket, err := lsh.encodeVector(point)
+// Query ... returns the union of the documents found in every table within searchRadius bits from the bucket
+// of point, each document being returned once. The documents of the closest buckets come first
+func (lsh *Index) Query(point []float64, searchRadius int) ([]any, error) {
+	lsh.mu.RLock()
+	defer lsh.mu.RUnlock()
+	return lsh.query(point, searchRadius, math.MaxInt)
+}
+
+// QueryAdaptive ... same as Query, growing the search radius one bit at a time until at least minCandidates
+// documents are found or maxRadius is reached. The bucket of point is always probed, even if minCandidates
+// is not positive
+func (lsh *Index) QueryAdaptive(point []float64, minCandidates int, maxRadius int) ([]any, error) {
+	lsh.mu.RLock()
+	defer lsh.mu.RUnlock()
+	return lsh.query(point, maxRadius, minCandidates)
+}
+
+func (lsh *Index) query(point []float64, maxRadius int, minCandidates int) ([]any, error) {
+	// retrieve query buckets
+	queryBuckets, err := lsh.encodeTables(point)
 	if err != nil {
 		return nil, err
 	}
-	_, exists := lsh.table[queryBucket]
-	if !exists {
-		return nil, fmt.Errorf("missing target bucket %v", queryBucket)
-	}
 
-	// retrieve neighboring buckets and collect their documents
+	// retrieve neighboring buckets by increasing distance and collect their documents,
+	// the query bucket itself may be empty while its neighbours are not
 	candidates := []any{}
-	for _, bucket := range lsh.getBucketsInRadius(queryBucket, searchRadius) {
-		// concatenate slices
-		candidates = append(candidates, lsh.table[bucket]...)
+	seen := map[any]struct{}{}
+	for r := 0; r <= maxRadius && (r == 0 || len(candidates) < minCandidates); r++ {
+		for t, table := range lsh.tables {
+			for _, bucket := range lsh.getBucketsAtDistance(t, queryBuckets[t], r) {
+				for _, document := range table.buckets[bucket] {
+					if _, duplicate := seen[document]; !duplicate {
+						seen[document] = struct{}{}
+						candidates = append(candidates, document)
+					}
+				}
+			}
+		}
 	}
 	return candidates, nil
 }
 
-func (lsh *lshUtil) SortByDescendingSimilarity(queryPoint []float64, candidates [][]float64) []common.DocumentRelevance {
+func (lsh *Index) SortByDescendingSimilarity(queryPoint []float64, candidates [][]float64) []common.DocumentRelevance {
 	// sort documents in descending similarity from query bucket
 	similarities := make([]common.DocumentRelevance, len(candidates))
 
@@ -1,25 +1,81 @@
 package lsh
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
 	"os"
-	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/pilillo/apostasi/common"
 	"github.com/stretchr/testify/assert"
 )
 
-var lshUtilTestInstance *lshUtil
+var lshUtilTestInstance *Index
 
 func TestMain(m *testing.M) {
 	lshUtilTestInstance = NewLshUtil(1234, 16)
-	lshUtilTestInstance.Init(0.0, 1.0, 7, 10)
+	lshUtilTestInstance.InitHyperplanes(7, false)
 	exitVal := m.Run()
 	os.Exit(exitVal)
 }
 
+// randomVectors ... returns n vectors with dim normally distributed components, the same ones for the same seed
+func randomVectors(seed int64, n, dim int) [][]float64 {
+	rng := rand.New(rand.NewSource(seed))
+	vectors := make([][]float64, n)
+	for i := range vectors {
+		vectors[i] = make([]float64, dim)
+		for j := range vectors[i] {
+			vectors[i][j] = rng.NormFloat64()
+		}
+	}
+	return vectors
+}
+
+// itemsOf ... returns the vectors as items identified by their position
+func itemsOf(vectors [][]float64) map[any][]float64 {
+	items := make(map[any][]float64, len(vectors))
+	for i, v := range vectors {
+		items[i] = v
+	}
+	return items
+}
+
 func TestInit(t *testing.T) {
-	assert.Equal(t, len(lshUtilTestInstance.randomVectors), 10, "wrong number of random vectors initialized")
+	assert.Equal(t, len(lshUtilTestInstance.tables[0].randomVectors), 16, "wrong number of random vectors initialized")
+}
+
+func TestInitHyperplanes(t *testing.T) {
+	orthogonal := NewLshUtil(1234, 10)
+	orthogonal.InitHyperplanes(4, true)
+	hyperplanes := orthogonal.tables[0].randomVectors
+	assert.Len(t, hyperplanes, 10)
+	for i, u := range hyperplanes {
+		assert.Len(t, u, 4)
+		assert.InDelta(t, 1.0, orthogonal.dot(u, u), 1e-9)
+		// hyperplanes are orthogonal within groups of numFeatures
+		for j := i - i%4; j < i; j++ {
+			assert.InDelta(t, 0.0, orthogonal.dot(u, hyperplanes[j]), 1e-9)
+		}
+	}
+
+	// unlike uniform components in [0, 1], normal components orient the hyperplanes in every direction,
+	// so that their bits are not correlated and the vectors are spread over many buckets
+	uniform := NewLshUtil(1234, 16)
+	uniform.Init(0.0, 1.0, 7, 16)
+	normalBuckets, uniformBuckets := map[signature]struct{}{}, map[signature]struct{}{}
+	for _, v := range randomVectors(1, 1000, 7) {
+		bucket, err := lshUtilTestInstance.encodeVector(0, v)
+		assert.NoError(t, err)
+		normalBuckets[bucket] = struct{}{}
+		bucket, err = uniform.encodeVector(0, v)
+		assert.NoError(t, err)
+		uniformBuckets[bucket] = struct{}{}
+	}
+	assert.Greater(t, len(normalBuckets), len(uniformBuckets)*3/2)
 }
 
 func TestDot(t *testing.T) {
@@ -29,77 +85,125 @@ func TestDot(t *testing.T) {
 
 func TestEncodeVector(t *testing.T) {
 	p := []float64{1, 2, 3, 4, 5, 6, 7}
-	v, err := lshUtilTestInstance.encodeVector(p)
+	v, err := lshUtilTestInstance.encodeVector(0, p)
+	assert.Nil(t, err)
+	// one bit per hyperplane, which are all crossed going from p to -p
+	opposite, err := lshUtilTestInstance.encodeVector(0, []float64{-1, -2, -3, -4, -5, -6, -7})
 	assert.Nil(t, err)
-	assert.Equal(t, int64(127), v, "wrong encoding for input vector")
+	assert.Equal(t, 16, v.hamming(opposite), "wrong encoding for input vector")
+
+	uninitialized := NewLshUtil(1234, 16)
+	uninitialized.Init(0.0, 1.0, 7, 10)
+	_, err = uninitialized.encodeVector(0, p)
+	assert.EqualError(t, err, "10 random vectors initialized, 16 are needed")
 }
 
 func TestInsertOne(t *testing.T) {
-	assert.Equal(t, 0, len(lshUtilTestInstance.table))
-	lshUtilTestInstance.InsertOne(0, []float64{1, 2, 3, 4, 5})
-	assert.Equal(t, 1, len(lshUtilTestInstance.table))
+	assert.Equal(t, 0, len(lshUtilTestInstance.tables[0].buckets))
+	assert.NoError(t, lshUtilTestInstance.InsertOne(0, []float64{1, 2, 3, 4, 5, 6, 7}))
+	assert.Equal(t, 1, len(lshUtilTestInstance.tables[0].buckets))
+	assert.EqualError(t, lshUtilTestInstance.InsertOne(1, []float64{1, 2, 3, 4, 5}), "vector has dimension 5, expected 7")
+	assert.Equal(t, 1, len(lshUtilTestInstance.tables[0].buckets))
 }
 
 func TestInsert(t *testing.T) {
-	lshUtilTestInstance.table = map[int64][]any{}
-	assert.Equal(t, 0, len(lshUtilTestInstance.table))
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{}
+	assert.Equal(t, 0, len(lshUtilTestInstance.tables[0].buckets))
 	data := map[any][]float64{}
 	lshUtilTestInstance.Insert(data)
-	assert.Equal(t, 0, len(lshUtilTestInstance.table))
+	assert.Equal(t, 0, len(lshUtilTestInstance.tables[0].buckets))
 	data = map[any][]float64{
-		1: {1, 2, 3, 4, 5},
+		1: {1, 2, 3, 4, 5, 6, 7},
 	}
-	lshUtilTestInstance.Insert(data)
-	assert.Equal(t, 1, len(lshUtilTestInstance.table))
-	assert.Equal(t, map[int64][]interface{}{31: {1}}, lshUtilTestInstance.table)
+	assert.NoError(t, lshUtilTestInstance.Insert(data))
+	assert.Equal(t, 1, len(lshUtilTestInstance.tables[0].buckets))
+	bucket, err := lshUtilTestInstance.encodeVector(0, data[1])
+	assert.NoError(t, err)
+	assert.Equal(t, map[signature][]interface{}{bucket: {1}}, lshUtilTestInstance.tables[0].buckets)
 }
 
 func TestFlip(t *testing.T) {
-	i, _ := strconv.ParseInt("0001", 2, 64)
-	assert.Equal(t, int64(0), lshUtilTestInstance.flip(i, []int{0}))
-	i, _ = strconv.ParseInt("0010", 2, 64)
-	assert.Equal(t, int64(0), lshUtilTestInstance.flip(i, []int{1}))
-	i, _ = strconv.ParseInt("0010", 2, 64)
-	assert.Equal(t, int64(4), lshUtilTestInstance.flip(i, []int{1, 2}))
+	assert.Equal(t, signature{0}, lshUtilTestInstance.flip(signature{0b0001}, []int{0}))
+	assert.Equal(t, signature{0}, lshUtilTestInstance.flip(signature{0b0010}, []int{1}))
+	assert.Equal(t, signature{0b0100}, lshUtilTestInstance.flip(signature{0b0010}, []int{1, 2}))
+	assert.Equal(t, signature{0, 0, 1 << 3}, lshUtilTestInstance.flip(signature{}, []int{131}))
 }
 
 func TestBucketsInRadius(t *testing.T) {
-	lshUtilTestInstance.table = map[int64][]any{
-		0: []any{}, 1: []any{}, 2: []any{}, 4: []any{}, 8: []any{}, 16: []any{},
-		32: []any{}, 64: []any{}, 128: []any{}, 256: []any{}, 1024: []any{},
-		2048: []any{}, 4096: []any{}, 8192: []any{}, 16384: []any{}, 32768: []any{},
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{
+		{0}: []any{}, {1}: []any{}, {2}: []any{}, {4}: []any{}, {8}: []any{}, {16}: []any{},
+		{32}: []any{}, {64}: []any{}, {128}: []any{}, {256}: []any{}, {1024}: []any{},
+		{2048}: []any{}, {4096}: []any{}, {8192}: []any{}, {16384}: []any{}, {32768}: []any{},
 	}
 
-	bucketsInRadius := lshUtilTestInstance.getBucketsInRadius(0, 0)
-	assert.Equal(t, []int64{0}, bucketsInRadius)
-	bucketsInRadius = lshUtilTestInstance.getBucketsInRadius(0, 1)
-	assert.Equal(t, []int64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 1024, 2048, 4096, 8192, 16384, 32768}, bucketsInRadius)
-	lshUtilTestInstance.table = map[int64][]any{}
+	bucketsInRadius := lshUtilTestInstance.getBucketsInRadius(0, signature{}, 0)
+	assert.Equal(t, []signature{{0}}, bucketsInRadius)
+	bucketsInRadius = lshUtilTestInstance.getBucketsInRadius(0, signature{}, 1)
+	assert.Equal(t, []signature{{0}, {1}, {2}, {4}, {8}, {16}, {32}, {64}, {128}, {256}, {1024}, {2048}, {4096}, {8192}, {16384}, {32768}}, bucketsInRadius)
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{}
 }
 
 func TestQuery(t *testing.T) {
-	lshUtilTestInstance.table = map[int64][]any{
+	queryBucket, err := lshUtilTestInstance.encodeVector(0, []float64{0, 0, 0, 1, 1, 1, 1})
+	assert.NoError(t, err)
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{
 		// bucketId : { docId ...}
-		127: {},
+		queryBucket: {},
 	}
 	documents, err := lshUtilTestInstance.Query([]float64{0, 0, 0, 1, 1, 1, 1}, 0)
 	assert.NoError(t, err)
 	assert.Empty(t, documents)
 
-	lshUtilTestInstance.table = map[int64][]any{
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{
 		// bucketId : { docId ...}
-		127: {1, 2, 3, 4},
+		queryBucket: {1, 2, 3, 4},
 	}
 	documents, err = lshUtilTestInstance.Query([]float64{0, 0, 0, 1, 1, 1, 1}, 0)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, documents)
 	assert.Equal(t, []any{1, 2, 3, 4}, documents)
+
+	// the query bucket is empty, but its neighbours are not
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{
+		// bucketId : { docId ...}
+		queryBucket.flip(3):                 {1, 2},
+		queryBucket.flip(5):                 {3},
+		queryBucket.flip(3).flip(7):         {4},
+		queryBucket.flip(1).flip(2).flip(3): {5},
+	}
+	documents, err = lshUtilTestInstance.Query([]float64{0, 0, 0, 1, 1, 1, 1}, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, documents)
+	documents, err = lshUtilTestInstance.Query([]float64{0, 0, 0, 1, 1, 1, 1}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{1, 2, 3}, documents)
+
+	// the adaptive query stops at the first radius providing enough documents
+	documents, err = lshUtilTestInstance.QueryAdaptive([]float64{0, 0, 0, 1, 1, 1, 1}, 4, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{1, 2, 3, 4}, documents)
+	documents, err = lshUtilTestInstance.QueryAdaptive([]float64{0, 0, 0, 1, 1, 1, 1}, 10, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{1, 2, 3, 4}, documents)
+	documents, err = lshUtilTestInstance.QueryAdaptive([]float64{0, 0, 0, 1, 1, 1, 1}, 10, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{1, 2, 3, 4, 5}, documents)
+
+	// the bucket of the query is probed even if no document is requested
+	lshUtilTestInstance.tables[0].buckets[queryBucket] = []any{0}
+	documents, err = lshUtilTestInstance.QueryAdaptive([]float64{0, 0, 0, 1, 1, 1, 1}, 0, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{0}, documents)
+	documents, err = lshUtilTestInstance.QueryAdaptive([]float64{0, 0, 0, 1, 1, 1, 1}, -1, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{0}, documents)
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{}
 }
 
 func TestSortByDescendingDistance(t *testing.T) {
-	lshUtilTestInstance.table = map[int64][]any{
+	lshUtilTestInstance.tables[0].buckets = map[signature][]any{
 		// bucketId : { docId ...}
-		127: {1, 2, 3, 4},
+		{127}: {1, 2, 3, 4},
 	}
 	queryDocumentVector := []float64{0, 0, 0, 1, 1, 1, 1}
 	relevance := lshUtilTestInstance.SortByDescendingSimilarity(
@@ -128,3 +232,516 @@ func TestSortByDescendingDistance(t *testing.T) {
 		relevance,
 	)
 }
+
+func TestMultipleTables(t *testing.T) {
+	multi := newIndex(42, 4, 7)
+	multi.Init(-1.0, 1.0, 7, 7)
+	assert.Len(t, multi.tables, 4)
+	assert.NotEqual(t, multi.tables[0].randomVectors, multi.tables[1].randomVectors)
+
+	data := itemsOf(randomVectors(42, 200, 7))
+	assert.NoError(t, multi.Insert(data))
+	for _, table := range multi.tables {
+		items := 0
+		for _, bucket := range table.buckets {
+			items += len(bucket)
+		}
+		assert.Equal(t, len(data), items)
+	}
+
+	// the documents are found in any of the tables, and returned once
+	documents, err := multi.Query(data[0], 0)
+	assert.NoError(t, err)
+	assert.Contains(t, documents, 0)
+	seen := map[any]struct{}{}
+	for _, d := range documents {
+		assert.NotContains(t, seen, d)
+		seen[d] = struct{}{}
+	}
+	for table := range multi.tables {
+		bucket, err := multi.encodeVector(table, data[0])
+		assert.NoError(t, err)
+		for _, d := range multi.tables[table].buckets[bucket] {
+			assert.Contains(t, seen, d)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	var s signature
+	s.set(0)
+	s.set(70)
+	s.set(255)
+	assert.True(t, s.bit(0))
+	assert.True(t, s.bit(70))
+	assert.True(t, s.bit(255))
+	assert.False(t, s.bit(1))
+	assert.Equal(t, signature{1, 1 << 6, 0, 1 << 63}, s)
+	assert.Equal(t, 3, s.hamming(signature{}))
+	assert.Equal(t, 0, s.hamming(s))
+	assert.Equal(t, 1, s.hamming(s.flip(200)))
+	assert.True(t, s.flip(200).bit(200))
+}
+
+func TestLongSignatures(t *testing.T) {
+	for _, numBits := range []int{64, 128, 256} {
+		long := newIndex(1234, 2, numBits)
+		long.InitHyperplanes(7, false)
+		p := []float64{1, 2, 3, 4, 5, 6, 7}
+		v, err := long.encodeVector(1, p)
+		assert.NoError(t, err)
+		opposite, err := long.encodeVector(1, []float64{-1, -2, -3, -4, -5, -6, -7})
+		assert.NoError(t, err)
+		assert.Equal(t, numBits, v.hamming(opposite))
+
+		// encoding does not allocate
+		allocs := testing.AllocsPerRun(100, func() { long.encodeVector(1, p) })
+		assert.Equal(t, 0.0, allocs)
+
+		assert.NoError(t, long.InsertOne("p", p))
+		documents, err := long.Query(p, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []any{"p"}, documents)
+	}
+
+	tooLong := NewLshUtil(1234, maxBits+1)
+	tooLong.InitHyperplanes(7, false)
+	_, err := tooLong.encodeVector(0, []float64{1, 2, 3, 4, 5, 6, 7})
+	assert.EqualError(t, err, "signatures of 257 bits are not supported, the max is 256")
+}
+
+func TestSearch(t *testing.T) {
+	data := itemsOf(randomVectors(7, 300, 5))
+
+	stored := newIndex(7, 4, 8)
+	stored.InitHyperplanes(5, false)
+	_, err := stored.Search(data[0], 5, 1)
+	assert.EqualError(t, err, "vectors are neither stored nor looked up")
+	stored.StoreVectors()
+	assert.NoError(t, stored.Insert(data))
+
+	neighbours, err := stored.Search(data[0], 5, 1)
+	assert.NoError(t, err)
+	assert.Len(t, neighbours, 5)
+	assert.Equal(t, 0, neighbours[0].ID)
+	assert.InDelta(t, 1.0, neighbours[0].Similarity, 1e-9)
+	_, err = stored.Search(data[0], -1, 1)
+	assert.EqualError(t, err, "invalid number of neighbours -1")
+	seen := map[any]struct{}{}
+	for i, n := range neighbours {
+		assert.NotContains(t, seen, n.ID)
+		seen[n.ID] = struct{}{}
+		similarity, _ := common.Cosine(data[0], data[n.ID])
+		assert.Equal(t, similarity, n.Similarity)
+		if i > 0 {
+			assert.GreaterOrEqual(t, neighbours[i-1].Similarity, n.Similarity)
+		}
+	}
+
+	// the same items are found when their vectors are looked up
+	lookedUp := newIndex(7, 4, 8)
+	lookedUp.InitHyperplanes(5, false)
+	lookedUp.SetVectorLookup(func(id any) ([]float64, bool) {
+		v, ok := data[id]
+		return v, ok
+	})
+	assert.NoError(t, lookedUp.Insert(data))
+	assert.Empty(t, lookedUp.vectors)
+	sameNeighbours, err := lookedUp.Search(data[0], 5, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, neighbours, sameNeighbours)
+
+	lookedUp.SetVectorLookup(func(id any) ([]float64, bool) { return nil, false })
+	_, err = lookedUp.Search(data[0], 5, 1)
+	assert.ErrorContains(t, err, "no vector found for id")
+}
+
+func TestMultiProbe(t *testing.T) {
+	probing := newIndex(11, 2, 10)
+	probing.InitHyperplanes(6, false)
+	p := []float64{0.3, -1.2, 0.5, 2.0, -0.7, 0.1}
+
+	// every bucket is probed once, by ascending sum of the margins of the flipped bits
+	queryBucket, err := probing.encodeVector(0, p)
+	assert.NoError(t, err)
+	probes, err := probing.probeSequence(0, p, 1<<10+5)
+	assert.NoError(t, err)
+	assert.Len(t, probes, 1<<10)
+	assert.Equal(t, queryBucket, probes[0])
+	score := func(bucket signature) (s float64) {
+		for i := 0; i < 10; i++ {
+			if bucket.bit(i) != queryBucket.bit(i) {
+				s += math.Abs(probing.dot(p, probing.tables[0].randomVectors[i]))
+			}
+		}
+		return
+	}
+	distinct := map[signature]struct{}{}
+	for i, bucket := range probes {
+		distinct[bucket] = struct{}{}
+		if i > 0 {
+			assert.LessOrEqual(t, score(probes[i-1]), score(bucket)+1e-12)
+		}
+	}
+	assert.Len(t, distinct, 1<<10)
+
+	// the first bit flipped is the one of the hyperplane closest to p
+	closest := 0
+	for i := 1; i < 10; i++ {
+		if math.Abs(probing.dot(p, probing.tables[0].randomVectors[i])) < math.Abs(probing.dot(p, probing.tables[0].randomVectors[closest])) {
+			closest = i
+		}
+	}
+	assert.Equal(t, queryBucket.flip(closest), probes[1])
+
+	data := itemsOf(randomVectors(11, 500, 6))
+	assert.NoError(t, probing.Insert(data))
+
+	// a single probe is the exact bucket, and probing every bucket finds every document
+	exact, err := probing.Query(p, 0)
+	assert.NoError(t, err)
+	documents, err := probing.QueryMultiProbe(p, 1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, exact, documents)
+	documents, err = probing.QueryMultiProbe(p, 1<<10)
+	assert.NoError(t, err)
+	assert.Len(t, documents, len(data))
+	documents, err = probing.QueryMultiProbe(p, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, documents)
+}
+
+func BenchmarkQuery(b *testing.B) {
+	bench := newIndex(1234, 4, 64)
+	bench.InitHyperplanes(32, false)
+	data := itemsOf(randomVectors(1234, 10000, 32))
+	if err := bench.Insert(data); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("radius", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := bench.Query(data[n%len(data)], 2); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("multiprobe", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := bench.QueryMultiProbe(data[n%len(data)], 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDeleteUpdate(t *testing.T) {
+	mutable := newIndex(5, 3, 8)
+	mutable.InitHyperplanes(4, false)
+	mutable.StoreVectors()
+	a, b := []float64{1, 2, 3, 4}, []float64{-4, -3, -2, -1}
+	assert.NoError(t, mutable.InsertOne("a", a))
+	assert.NoError(t, mutable.InsertOne("b", b))
+	assert.NoError(t, mutable.InsertOne("c", a))
+	assert.EqualError(t, mutable.InsertOne("a", b), "item a already exists")
+
+	// the item is moved to the buckets of its new vector in every table
+	assert.NoError(t, mutable.Update("a", b))
+	documents, err := mutable.Query(b, 0)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []any{"a", "b"}, documents)
+	documents, err = mutable.Query(a, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"c"}, documents)
+	assert.Equal(t, b, mutable.vectors["a"])
+
+	assert.EqualError(t, mutable.Update("d", a), "no item found for id: d")
+
+	assert.NoError(t, mutable.Delete("c"))
+	assert.EqualError(t, mutable.Delete("c"), "no item found for id: c")
+	documents, err = mutable.Query(a, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, documents)
+	for _, table := range mutable.tables {
+		// the bucket of c was left empty and dropped
+		assert.Len(t, table.buckets, 1)
+	}
+	assert.NotContains(t, mutable.vectors, "c")
+
+	// a deleted item can be inserted again
+	assert.NoError(t, mutable.InsertOne("c", a))
+	documents, err = mutable.Query(a, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"c"}, documents)
+
+	// a batch containing an existing item is not inserted at all, whatever the iteration order of the map
+	batch := itemsOf(randomVectors(5, 20, 4))
+	batch["b"] = a
+	for i := 0; i < 10; i++ {
+		assert.EqualError(t, mutable.Insert(batch), "item b already exists")
+		assert.Len(t, mutable.itemBuckets, 3)
+		assert.Len(t, mutable.vectors, 3)
+	}
+}
+
+func TestReencode(t *testing.T) {
+	redrawn := newIndex(5, 2, 8)
+	redrawn.InitHyperplanes(4, false)
+	v := []float64{1, -2, 3, -4}
+	stale, generation, err := redrawn.encode(v)
+	assert.NoError(t, err)
+	kept, err := redrawn.reencode(v, stale, generation)
+	assert.NoError(t, err)
+	assert.Equal(t, stale, kept)
+
+	// the hyperplanes are redrawn between the encoding and the write lock, as by a concurrent InitHyperplanes
+	redrawn.InitHyperplanes(4, false)
+	current, err := redrawn.encodeTables(v)
+	assert.NoError(t, err)
+	assert.NotEqual(t, stale, current)
+	reencoded, err := redrawn.reencode(v, stale, generation)
+	assert.NoError(t, err)
+	assert.Equal(t, current, reencoded)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	// meant to be run with -race
+	shared := newIndex(3, 2, 12)
+	shared.InitHyperplanes(8, false)
+	shared.StoreVectors()
+	vectors := randomVectors(3, 400, 8)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		// writers insert their own items, update half of them and delete a quarter of them
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(vectors); i += 4 {
+				if err := shared.InsertOne(i, vectors[i]); err != nil {
+					errs <- err
+				}
+				if i%2 == 0 {
+					if err := shared.Update(i, vectors[len(vectors)-1-i]); err != nil {
+						errs <- err
+					}
+				}
+				if i%4 == 0 {
+					if err := shared.Delete(i); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+		// readers query concurrently
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(vectors); i += 4 {
+				if _, err := shared.Query(vectors[i], 1); err != nil {
+					errs <- err
+				}
+				if _, err := shared.QueryMultiProbe(vectors[i], 10); err != nil {
+					errs <- err
+				}
+				if _, err := shared.Search(vectors[i], 5, 1); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, shared.itemBuckets, len(vectors)*3/4)
+	for _, table := range shared.tables {
+		items := 0
+		for _, bucket := range table.buckets {
+			items += len(bucket)
+		}
+		assert.Equal(t, len(vectors)*3/4, items)
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(0)
+	assert.EqualError(t, err, "invalid dimension 0")
+	_, err = New(4, Options{Bits: maxBits + 1})
+	assert.EqualError(t, err, "invalid number of bits 257, the max is 256")
+	_, err = New(4, Options{Tables: -1})
+	assert.EqualError(t, err, "invalid number of tables -1")
+	_, err = New(4, Options{Tables: maxTables + 1})
+	assert.EqualError(t, err, "invalid number of tables 4097, the max is 4096")
+	_, err = New(4, Options{}, Options{})
+	assert.EqualError(t, err, "at most one Options can be provided")
+
+	defaults, err := New(4)
+	assert.NoError(t, err)
+	assert.Len(t, defaults.tables, 1)
+	assert.Len(t, defaults.tables[0].randomVectors, 16)
+	assert.Nil(t, defaults.vectors)
+
+	// indexes own their random source, so that creating another one does not change their hyperplanes
+	first, err := New(8, Options{Seed: 1, Tables: 3, Bits: 32, StoreVectors: true})
+	assert.NoError(t, err)
+	_, err = New(8, Options{Seed: 2, Tables: 3, Bits: 32})
+	assert.NoError(t, err)
+	rand.Seed(3)
+	second, err := New(8, Options{Seed: 1, Tables: 3, Bits: 32, StoreVectors: true})
+	assert.NoError(t, err)
+	assert.Len(t, first.tables, 3)
+	for table := range first.tables {
+		assert.Len(t, first.tables[table].randomVectors, 32)
+		assert.Equal(t, first.tables[table].randomVectors, second.tables[table].randomVectors)
+	}
+
+	p := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(t, first.InsertOne("p", p))
+	neighbours, err := first.Search(p, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "p", neighbours[0].ID)
+	_, err = first.Query(p[:4], 0)
+	assert.EqualError(t, err, "vector has dimension 4, expected 8")
+}
+
+func TestNotInitialized(t *testing.T) {
+	uninitialized := NewLshUtil(1234, 8)
+	uninitialized.StoreVectors()
+	p := []float64{1, 2, 3}
+	assert.ErrorIs(t, uninitialized.InsertOne(0, p), errNotInitialized)
+	_, err := uninitialized.Query(p, 1)
+	assert.ErrorIs(t, err, errNotInitialized)
+	_, err = uninitialized.QueryMultiProbe(p, 10)
+	assert.ErrorIs(t, err, errNotInitialized)
+	_, err = uninitialized.Search(p, 1, 1)
+	assert.ErrorIs(t, err, errNotInitialized)
+
+	// the zero value has no tables at all
+	var zero Index
+	assert.ErrorIs(t, zero.InsertOne(0, p), errNotInitialized)
+	assert.ErrorIs(t, zero.Insert(map[any][]float64{0: p}), errNotInitialized)
+	assert.ErrorIs(t, zero.Update(0, p), errNotInitialized)
+	assert.EqualError(t, zero.Delete(0), "no item found for id: 0")
+	_, err = zero.Query(p, 1)
+	assert.ErrorIs(t, err, errNotInitialized)
+	_, err = zero.QueryMultiProbe(p, 10)
+	assert.ErrorIs(t, err, errNotInitialized)
+	zero.StoreVectors()
+	_, err = zero.Search(p, 1, 1)
+	assert.ErrorIs(t, err, errNotInitialized)
+	assert.ErrorIs(t, zero.Save(&bytes.Buffer{}), errNotInitialized)
+}
+
+func TestSaveLoad(t *testing.T) {
+	original, err := New(6, Options{Seed: 9, Tables: 3, Bits: 70, StoreVectors: true})
+	assert.NoError(t, err)
+	ids := []any{3, -1, int64(7), int64(1 << 40), "a", "", "doc-42"}
+	vectors := randomVectors(9, len(ids)+1, 6)
+	for i, id := range ids {
+		assert.NoError(t, original.InsertOne(id, vectors[i]))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, original.Save(&buf))
+	loaded, err := Load(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+
+	// ids keep their type, and the items are found in the same buckets
+	assert.Equal(t, original.dim, loaded.dim)
+	assert.Equal(t, original.numBits, loaded.numBits)
+	assert.Equal(t, original.seed, loaded.seed)
+	assert.Equal(t, original.itemBuckets, loaded.itemBuckets)
+	assert.Equal(t, original.vectors, loaded.vectors)
+	for table := range original.tables {
+		assert.Equal(t, original.tables[table].randomVectors, loaded.tables[table].randomVectors)
+		assert.Len(t, loaded.tables[table].buckets, len(original.tables[table].buckets))
+		for bucket, documents := range original.tables[table].buckets {
+			assert.ElementsMatch(t, documents, loaded.tables[table].buckets[bucket])
+		}
+	}
+	for _, id := range ids {
+		neighbours, err := loaded.Search(original.vectors[id], 1, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, id, neighbours[0].ID)
+	}
+
+	// saving is stable and the loaded index is a regular one
+	var again bytes.Buffer
+	assert.NoError(t, loaded.Save(&again))
+	assert.Equal(t, buf.Bytes(), again.Bytes())
+	assert.NoError(t, loaded.Delete("a"))
+	assert.NoError(t, loaded.InsertOne(int64(8), vectors[len(ids)]))
+
+	// items inserted before the vectors were stored are saved without vector
+	partial := NewLshUtil(1, 8)
+	partial.InitHyperplanes(3, false)
+	assert.NoError(t, partial.InsertOne("old", []float64{1, 2, 3}))
+	partial.StoreVectors()
+	assert.NoError(t, partial.InsertOne("new", []float64{3, 2, 1}))
+	buf.Reset()
+	assert.NoError(t, partial.Save(&buf))
+	loaded, err = Load(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, map[any][]float64{"new": {3, 2, 1}}, loaded.vectors)
+	assert.Len(t, loaded.itemBuckets, 2)
+
+	unsupported := NewLshUtil(1, 8)
+	unsupported.InitHyperplanes(3, false)
+	assert.NoError(t, unsupported.InsertOne(1.5, []float64{1, 2, 3}))
+	assert.EqualError(t, unsupported.Save(&buf), "unsupported id type float64, only int, int64 and string ids can be saved")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	index, err := New(4, Options{Seed: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, index.InsertOne("a", []float64{1, 2, 3, 4}))
+	var buf bytes.Buffer
+	assert.NoError(t, index.Save(&buf))
+	data := buf.Bytes()
+
+	_, err = Load(bytes.NewReader([]byte("APAN")))
+	assert.ErrorContains(t, err, "reading index header")
+
+	corrupted := append([]byte{}, data...)
+	copy(corrupted, "APAN")
+	_, err = Load(bytes.NewReader(corrupted))
+	assert.EqualError(t, err, "not an LSH index file")
+
+	corrupted = append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(corrupted[4:], formatVersion+1)
+	_, err = Load(bytes.NewReader(corrupted))
+	assert.EqualError(t, err, "unsupported index format version 2, expected at most 1")
+
+	_, err = Load(bytes.NewReader(data[:len(data)-1]))
+	assert.ErrorContains(t, err, "reading vector of item a")
+
+	// corrupt counts fail once the input is exhausted, instead of allocating all the values up front
+	header := binary.Size(fileHeader{})
+	item := header + 16*4*8
+	corrupt := func(offset int, value uint64, size int) error {
+		corrupted := append([]byte{}, data...)
+		if size == 4 {
+			binary.LittleEndian.PutUint32(corrupted[offset:], uint32(value))
+		} else {
+			binary.LittleEndian.PutUint64(corrupted[offset:], value)
+		}
+		_, err := Load(bytes.NewReader(corrupted))
+		return err
+	}
+	assert.EqualError(t, corrupt(item+1, 1<<31, 4), "reading id of item 0: unexpected EOF")
+	assert.EqualError(t, corrupt(36, 1<<31, 8), "reading id of item 1: unexpected EOF")
+	assert.EqualError(t, corrupt(16, 1<<20, 4), "reading hyperplane 0 of table 0: unexpected EOF")
+
+	// the number of tables and hyperplanes is bounded on its own, not only by the size of the hyperplanes
+	assert.EqualError(t, corrupt(24, 50_000_000, 4), "invalid number of tables 50000000, the max is 4096")
+	assert.EqualError(t, corrupt(28, 1<<20, 4), "invalid number of hyperplanes 1048576, the max is 256")
+	assert.EqualError(t, corrupt(28, 8, 4), "invalid number of hyperplanes 8, 16 are needed")
+	withoutHyperplanes := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(withoutHyperplanes[24:], 50_000_000)
+	binary.LittleEndian.PutUint32(withoutHyperplanes[28:], 0)
+	_, err = Load(bytes.NewReader(withoutHyperplanes))
+	assert.EqualError(t, err, "invalid number of tables 50000000, the max is 4096")
+}
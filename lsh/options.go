@@ -0,0 +1,76 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultTables = 1
+	defaultBits   = 16
+	// maxTables ... max number of hash tables, which bounds the tables allocated by Load before reading them
+	maxTables = 1 << 12
+)
+
+// RandomSeed is the zero value of Options.Seed, which draws the hyperplanes of every index from the current time,
+// so that two indexes over the same items hash them differently
+const RandomSeed int64 = 0
+
+// Options are the optional settings used to build an index with New, the zero value builds a single table
+// of 16 bits with randomly seeded hyperplanes
+type Options struct {
+	// Seed ... seeds the random hyperplanes, so that two indexes with the same seed hash the items the same way.
+	// The zero value is RandomSeed, a different seed for every index
+	Seed int64
+	// Tables ... number of independent hash tables, defaults to 1
+	Tables int
+	// Bits ... number of bits of the signatures, i.e. of hyperplanes per table, defaults to 16
+	Bits int
+	// Orthogonal ... orthogonalises the hyperplanes of every table, see InitHyperplanes
+	Orthogonal bool
+	// StoreVectors ... keeps the vectors of the inserted items, so that Search can rank them
+	StoreVectors bool
+}
+
+// optionsOf ... returns the options passed to New, or the defaults if none was passed
+func optionsOf(opts []Options) (Options, error) {
+	if len(opts) == 0 {
+		return Options{}, nil
+	}
+	if len(opts) > 1 {
+		return Options{}, errors.New("at most one Options can be provided")
+	}
+	if opts[0].Tables < 0 {
+		return Options{}, fmt.Errorf("invalid number of tables %d", opts[0].Tables)
+	}
+	if opts[0].Tables > maxTables {
+		return Options{}, fmt.Errorf("invalid number of tables %d, the max is %d", opts[0].Tables, maxTables)
+	}
+	if opts[0].Bits < 0 || opts[0].Bits > maxBits {
+		return Options{}, fmt.Errorf("invalid number of bits %d, the max is %d", opts[0].Bits, maxBits)
+	}
+	return opts[0], nil
+}
+
+func (o Options) tables() int {
+	if o.Tables == 0 {
+		return defaultTables
+	}
+	return o.Tables
+}
+
+func (o Options) bits() int {
+	if o.Bits == 0 {
+		return defaultBits
+	}
+	return o.Bits
+}
+
+// seed ... returns the seed of the hyperplanes, drawn from the current time for RandomSeed
+func (o Options) seed() int64 {
+	if o.Seed == RandomSeed {
+		return time.Now().UnixNano()
+	}
+	return o.Seed
+}
@@ -0,0 +1,117 @@
+package lsh
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// perturbation ... set of bits to flip in a query bucket, as positions in the bits sorted by ascending margin
+type perturbation struct {
+	positions []int
+	score     float64
+}
+
+// perturbationQueue ... min-heap of perturbations by score
+type perturbationQueue []perturbation
+
+func (q perturbationQueue) Len() int {
+	return len(q)
+}
+
+func (q perturbationQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q perturbationQueue) Less(i, j int) bool {
+	return q[i].score < q[j].score
+}
+
+func (q *perturbationQueue) Push(x any) {
+	*q = append(*q, x.(perturbation))
+}
+
+func (q *perturbationQueue) Pop() any {
+	old := *q
+	n := len(old)
+	p := old[n-1]
+	*q = old[0 : n-1]
+	return p
+}
+
+// QueryMultiProbe ... returns the documents found in the numProbes buckets of every table that are the most likely
+// to contain the neighbours of point, each document being returned once. Instead of enumerating all the buckets
+// within a radius, the bits are flipped starting from the ones whose hyperplane is the closest to point,
+// i.e. with the smallest magnitude of the projection, which requires fewer probes for the same recall
+func (lsh *Index) QueryMultiProbe(point []float64, numProbes int) ([]any, error) {
+	lsh.mu.RLock()
+	defer lsh.mu.RUnlock()
+	if len(lsh.tables) == 0 {
+		return nil, errNotInitialized
+	}
+	candidates := []any{}
+	seen := map[any]struct{}{}
+	for t, table := range lsh.tables {
+		probes, err := lsh.probeSequence(t, point, numProbes)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range probes {
+			for _, document := range table.buckets[bucket] {
+				if _, duplicate := seen[document]; !duplicate {
+					seen[document] = struct{}{}
+					candidates = append(candidates, document)
+				}
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// probeSequence ... returns the first numProbes buckets of a table to probe for point, starting from its own bucket,
+// by ascending sum of the margins of the flipped bits. The perturbation sets are generated lazily with the
+// shift and expand operations of multi-probe LSH, so that each one is generated once
+func (lsh *Index) probeSequence(table int, point []float64, numProbes int) ([]signature, error) {
+	queryBucket, err := lsh.encodeVector(table, point)
+	if err != nil {
+		return nil, err
+	}
+	if numProbes <= 0 {
+		return nil, nil
+	}
+
+	// sort the bits by the distance of point from their hyperplane
+	margins := make([]float64, lsh.numBits)
+	order := make([]int, lsh.numBits)
+	for i := range margins {
+		margins[i] = math.Abs(lsh.dot(point, lsh.tables[table].randomVectors[i]))
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return margins[order[a]] < margins[order[b]] })
+
+	probes := []signature{queryBucket}
+	pq := perturbationQueue{}
+	if lsh.numBits > 0 {
+		pq = append(pq, perturbation{positions: []int{0}, score: margins[order[0]]})
+	}
+	for len(probes) < numProbes && pq.Len() > 0 {
+		p := heap.Pop(&pq).(perturbation)
+		bucket := queryBucket
+		for _, position := range p.positions {
+			bucket = bucket.flip(order[position])
+		}
+		probes = append(probes, bucket)
+
+		last := p.positions[len(p.positions)-1]
+		if last+1 >= lsh.numBits {
+			continue
+		}
+		// shift ... replaces the last bit with the next one
+		shifted := append(append([]int{}, p.positions[:len(p.positions)-1]...), last+1)
+		heap.Push(&pq, perturbation{positions: shifted, score: p.score - margins[order[last]] + margins[order[last+1]]})
+		// expand ... adds the next bit
+		expanded := append(append([]int{}, p.positions...), last+1)
+		heap.Push(&pq, perturbation{positions: expanded, score: p.score + margins[order[last+1]]})
+	}
+	return probes, nil
+}
@@ -0,0 +1,86 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pilillo/apostasi/common"
+)
+
+// Neighbor is an item found by Search, along with its cosine similarity to the query point
+type Neighbor struct {
+	ID         any
+	Similarity float64
+}
+
+// StoreVectors ... keeps the vectors of the items inserted from now on, so that Search can rank them
+func (lsh *Index) StoreVectors() {
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	if lsh.vectors == nil {
+		lsh.vectors = map[any][]float64{}
+	}
+}
+
+// SetVectorLookup ... sets the function used by Search to get the vectors of the items that are not stored,
+// e.g. because they are kept in an external store. It may be called concurrently and must not use the index
+func (lsh *Index) SetVectorLookup(lookup func(id any) ([]float64, bool)) {
+	lsh.mu.Lock()
+	defer lsh.mu.Unlock()
+	lsh.lookup = lookup
+}
+
+// Search ... returns the k items found by Query that are most similar to point, by descending cosine similarity
+func (lsh *Index) Search(point []float64, k int, searchRadius int) ([]Neighbor, error) {
+	if k < 0 {
+		return nil, fmt.Errorf("invalid number of neighbours %d", k)
+	}
+	lsh.mu.RLock()
+	defer lsh.mu.RUnlock()
+	if lsh.vectors == nil && lsh.lookup == nil {
+		return nil, errors.New("vectors are neither stored nor looked up")
+	}
+
+	// 1. collect the candidates, which are already deduplicated across buckets and tables
+	candidates, err := lsh.query(point, searchRadius, math.MaxInt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. rank the candidates by their similarity to point
+	neighbours := make([]Neighbor, len(candidates))
+	for i, id := range candidates {
+		vector, err := lsh.vector(id)
+		if err != nil {
+			return nil, err
+		}
+		if neighbours[i].Similarity, err = common.Cosine(point, vector); err != nil {
+			return nil, err
+		}
+		neighbours[i].ID = id
+	}
+	sort.SliceStable(neighbours, func(i, j int) bool {
+		return neighbours[i].Similarity > neighbours[j].Similarity
+	})
+
+	// 3. return top k
+	if len(neighbours) > k {
+		neighbours = neighbours[:k]
+	}
+	return neighbours, nil
+}
+
+// vector ... returns the stored vector of an item, or the one returned by the lookup function
+func (lsh *Index) vector(id any) ([]float64, error) {
+	if vector, ok := lsh.vectors[id]; ok {
+		return vector, nil
+	}
+	if lsh.lookup != nil {
+		if vector, ok := lsh.lookup(id); ok {
+			return vector, nil
+		}
+	}
+	return nil, fmt.Errorf("no vector found for id: %v", id)
+}
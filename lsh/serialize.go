@@ -0,0 +1,353 @@
+package lsh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// the on-disk layout of an index is:
+//
+//	header      ... fixed size, see fileHeader
+//	hyperplanes ... numTables x numHyperplanes x dim x float64
+//	items       ... numItems x (id, numTables x signature, vector)
+//
+// ids start with their kind (uint8), followed by an int64 for int and int64 ids, or by the length (uint32)
+// and the bytes of string ids. Signatures are 4 x uint64, the bucket of the item in each table.
+// Vectors start with a uint8 set to 1 if the vector is stored, followed by dim x float64.
+// All values are little endian, items are ordered by kind and id.
+const formatVersion uint32 = 1
+
+var formatMagic = [4]byte{'A', 'P', 'L', 'S'}
+
+var byteOrder = binary.LittleEndian
+
+type fileHeader struct {
+	Magic          [4]byte
+	Version        uint32
+	Seed           int64
+	Dim            uint32
+	NumBits        uint32
+	NumTables      uint32
+	NumHyperplanes uint32
+	StoreVectors   uint32
+	NumItems       uint64
+}
+
+// idKind ... type of the ids that can be saved, so that they are loaded with the same type
+type idKind uint8
+
+const (
+	intId idKind = iota
+	int64Id
+	stringId
+)
+
+func kindOf(id any) (idKind, error) {
+	switch id.(type) {
+	case int:
+		return intId, nil
+	case int64:
+		return int64Id, nil
+	case string:
+		return stringId, nil
+	default:
+		return 0, fmt.Errorf("unsupported id type %T, only int, int64 and string ids can be saved", id)
+	}
+}
+
+// lessId ... orders the ids by kind, then by value
+func lessId(a, b any) bool {
+	ka, _ := kindOf(a)
+	kb, _ := kindOf(b)
+	if ka != kb {
+		return ka < kb
+	}
+	switch a := a.(type) {
+	case int:
+		return a < b.(int)
+	case int64:
+		return a < b.(int64)
+	default:
+		return a.(string) < b.(string)
+	}
+}
+
+// Save writes the hyperplanes, the buckets of the items and their stored vectors to w, in a versioned binary
+// format that can be read back with Load. The vector lookup function is not saved
+func (lsh *Index) Save(w io.Writer) error {
+	lsh.mu.RLock()
+	defer lsh.mu.RUnlock()
+	if len(lsh.tables) == 0 {
+		return errNotInitialized
+	}
+
+	// 1. order the items so that saving the same index twice gives the same bytes
+	ids := make([]any, 0, len(lsh.itemBuckets))
+	for id := range lsh.itemBuckets {
+		if _, err := kindOf(id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return lessId(ids[a], ids[b]) })
+
+	// 2. write all sections
+	numHyperplanes := len(lsh.tables[0].randomVectors)
+	for t, table := range lsh.tables {
+		if len(table.randomVectors) != numHyperplanes {
+			return fmt.Errorf("table %d has %d hyperplanes, expected %d", t, len(table.randomVectors), numHyperplanes)
+		}
+	}
+	if len(lsh.tables) > maxTables {
+		return fmt.Errorf("%d tables cannot be saved, the max is %d", len(lsh.tables), maxTables)
+	}
+	if numHyperplanes == 0 {
+		return errNotInitialized
+	}
+	if numHyperplanes < lsh.numBits || numHyperplanes > maxBits {
+		return fmt.Errorf("%d hyperplanes per table cannot be saved, between %d and %d are needed",
+			numHyperplanes, lsh.numBits, maxBits)
+	}
+	bw := bufio.NewWriter(w)
+	header := fileHeader{
+		Magic:          formatMagic,
+		Version:        formatVersion,
+		Seed:           lsh.seed,
+		Dim:            uint32(lsh.dim),
+		NumBits:        uint32(lsh.numBits),
+		NumTables:      uint32(len(lsh.tables)),
+		NumHyperplanes: uint32(numHyperplanes),
+		NumItems:       uint64(len(ids)),
+	}
+	if lsh.vectors != nil {
+		header.StoreVectors = 1
+	}
+	if err := binary.Write(bw, byteOrder, header); err != nil {
+		return err
+	}
+	for _, table := range lsh.tables {
+		for _, hyperplane := range table.randomVectors {
+			if len(hyperplane) != lsh.dim {
+				return fmt.Errorf("hyperplane has dimension %d, expected %d", len(hyperplane), lsh.dim)
+			}
+			if err := binary.Write(bw, byteOrder, hyperplane); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range ids {
+		if err := writeId(bw, id); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, byteOrder, lsh.itemBuckets[id]); err != nil {
+			return err
+		}
+		vector, stored := lsh.vectors[id]
+		if !stored {
+			if err := bw.WriteByte(0); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(vector) != lsh.dim {
+			return fmt.Errorf("item %v has dimension %d, expected %d", id, len(vector), lsh.dim)
+		}
+		if err := bw.WriteByte(1); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, byteOrder, vector); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeId(w *bufio.Writer, id any) error {
+	kind, err := kindOf(id)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteByte(byte(kind)); err != nil {
+		return err
+	}
+	switch id := id.(type) {
+	case int:
+		return binary.Write(w, byteOrder, int64(id))
+	case int64:
+		return binary.Write(w, byteOrder, id)
+	default:
+		s := id.(string)
+		if err := binary.Write(w, byteOrder, uint32(len(s))); err != nil {
+			return err
+		}
+		_, err := w.WriteString(s)
+		return err
+	}
+}
+
+func readId(r *bufio.Reader) (any, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch idKind(kind) {
+	case intId, int64Id:
+		var id int64
+		if err := binary.Read(r, byteOrder, &id); err != nil {
+			return nil, err
+		}
+		if idKind(kind) == intId {
+			if id > math.MaxInt || id < math.MinInt {
+				return nil, fmt.Errorf("int id %d out of range", id)
+			}
+			return int(id), nil
+		}
+		return id, nil
+	case stringId:
+		var length uint32
+		if err := binary.Read(r, byteOrder, &length); err != nil {
+			return nil, err
+		}
+		s, err := readSlice[byte](r, uint64(length))
+		if err != nil {
+			return nil, err
+		}
+		return string(s), nil
+	default:
+		return nil, fmt.Errorf("unknown id kind %d", kind)
+	}
+}
+
+// Load reads an index previously written with Save, validating its format version and dimensions
+func Load(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+
+	// 1. read and validate the header
+	var header fileHeader
+	if err := binary.Read(br, byteOrder, &header); err != nil {
+		return nil, fmt.Errorf("reading index header: %w", err)
+	}
+	if err := header.validate(); err != nil {
+		return nil, err
+	}
+	lsh := newIndex(header.Seed, int(header.NumTables), int(header.NumBits))
+	lsh.dim = int(header.Dim)
+	if header.StoreVectors != 0 {
+		lsh.vectors = map[any][]float64{}
+	}
+
+	// 2. read the hyperplanes
+	for t, table := range lsh.tables {
+		table.randomVectors = make([][]float64, header.NumHyperplanes)
+		for i := range table.randomVectors {
+			var err error
+			if table.randomVectors[i], err = readSlice[float64](br, uint64(lsh.dim)); err != nil {
+				return nil, fmt.Errorf("reading hyperplane %d of table %d: %w", i, t, err)
+			}
+		}
+	}
+
+	// 3. read the items and put them back in their buckets
+	for n := uint64(0); n < header.NumItems; n++ {
+		id, err := readId(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading id of item %d: %w", n, unexpectedEOF(err))
+		}
+		if _, exists := lsh.itemBuckets[id]; exists {
+			return nil, fmt.Errorf("duplicate item id %v", id)
+		}
+		bucketIndexes, err := readSlice[signature](br, uint64(len(lsh.tables)))
+		if err != nil {
+			return nil, fmt.Errorf("reading buckets of item %v: %w", id, err)
+		}
+		stored, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading vector of item %v: %w", id, unexpectedEOF(err))
+		}
+		var vector []float64
+		if stored != 0 {
+			if lsh.vectors == nil {
+				return nil, fmt.Errorf("item %v has a vector, but vectors are not stored", id)
+			}
+			if vector, err = readSlice[float64](br, uint64(lsh.dim)); err != nil {
+				return nil, fmt.Errorf("reading vector of item %v: %w", id, err)
+			}
+		}
+		lsh.add(id, vector, bucketIndexes)
+		if vector == nil {
+			// the item was inserted before its vector could be stored
+			delete(lsh.vectors, id)
+		}
+	}
+	return lsh, nil
+}
+
+// readChunkSize ... max number of values allocated at once by readSlice
+const readChunkSize = 1 << 16
+
+// readSlice ... reads n values from r in chunks, so that a corrupt count fails with an error once the input
+// is exhausted instead of allocating all the values up front
+func readSlice[T any](r io.Reader, n uint64) ([]T, error) {
+	size := n
+	if size > readChunkSize {
+		size = readChunkSize
+	}
+	values := make([]T, 0, size)
+	for uint64(len(values)) < n {
+		chunk := n - uint64(len(values))
+		if chunk > readChunkSize {
+			chunk = readChunkSize
+		}
+		buf := make([]T, chunk)
+		if err := binary.Read(r, byteOrder, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		values = append(values, buf...)
+	}
+	return values, nil
+}
+
+// unexpectedEOF ... reports the end of the input as unexpected, since it is only reached before all the
+// values announced by the header are read
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (h fileHeader) validate() error {
+	if h.Magic != formatMagic {
+		return errors.New("not an LSH index file")
+	}
+	if h.Version == 0 || h.Version > formatVersion {
+		return fmt.Errorf("unsupported index format version %d, expected at most %d", h.Version, formatVersion)
+	}
+	if h.NumTables == 0 {
+		return errors.New("invalid index without tables")
+	}
+	if h.NumTables > maxTables {
+		return fmt.Errorf("invalid number of tables %d, the max is %d", h.NumTables, maxTables)
+	}
+	if h.NumBits > maxBits {
+		return fmt.Errorf("invalid number of bits %d, the max is %d", h.NumBits, maxBits)
+	}
+	if h.NumHyperplanes > maxBits {
+		return fmt.Errorf("invalid number of hyperplanes %d, the max is %d", h.NumHyperplanes, maxBits)
+	}
+	if h.NumHyperplanes < h.NumBits {
+		return fmt.Errorf("invalid number of hyperplanes %d, %d are needed", h.NumHyperplanes, h.NumBits)
+	}
+	if h.NumHyperplanes > 0 && h.Dim == 0 {
+		return errors.New("invalid index dimension 0")
+	}
+	if uint64(h.NumTables)*uint64(h.NumHyperplanes)*uint64(h.Dim) > math.MaxInt32 || h.NumItems > math.MaxUint32 {
+		return errors.New("index too large")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package lsh
+
+import "math/bits"
+
+const (
+	// signatureWords ... number of 64 bits words of a signature
+	signatureWords = 4
+	// maxBits ... max number of bits of a signature, i.e. of hyperplanes per table
+	maxBits = 64 * signatureWords
+)
+
+// signature identifies a bucket with one bit per hyperplane, bit i being set if the point is on the positive side
+// of the i-th hyperplane. It is packed in words rather than in a slice so that it can be used as a map key
+type signature [signatureWords]uint64
+
+func (s signature) bit(i int) bool {
+	return s[i/64]&(1<<(i%64)) != 0
+}
+
+func (s *signature) set(i int) {
+	s[i/64] |= 1 << (i % 64)
+}
+
+// flip ... returns the signature with the given bit inverted
+func (s signature) flip(i int) signature {
+	s[i/64] ^= 1 << (i % 64)
+	return s
+}
+
+// hamming ... returns the number of bits that differ between two signatures
+func (s signature) hamming(other signature) int {
+	distance := 0
+	for w := range s {
+		distance += bits.OnesCount64(s[w] ^ other[w])
+	}
+	return distance
+}